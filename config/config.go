@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,20 +25,58 @@ type SessionRagen struct {
 }
 
 type Config struct {
-	Sessions               []SessionInfo
-	Address                string
-	APIKey                 string
-	Proxy                  string
-	ChatDelete             bool
-	MaxChatHistoryLength   int
-	MaxContextMessages     int
-	RetryCount             int
-	NoRolePrefix           bool
-	PromptDisableArtifacts bool
-	EnableMirrorApi        bool
-	MirrorApiPrefix        string
-	BigContextPrompt       string // 用于大型上下文的自定义提示词
-	RwMutx                 sync.RWMutex
+	Sessions                  []SessionInfo
+	Address                   string
+	APIKey                    string
+	Proxy                     string
+	ChatDelete                bool
+	MaxChatHistoryLength      int
+	BigContextImageBytes      int // 图片总字节数超过该值时也使用文件上下文，0 表示不启用
+	MaxContextMessages        int
+	HardMaxMessages           int // 请求设置 no_trim 时仍然生效的消息数量上限，0 表示不限制
+	RetryCount                int
+	NoRolePrefix              bool
+	StopOnHumanTurn           bool // Claude 续写出新的 Human 轮次时截断回复
+	PromptDisableArtifacts    bool
+	EnableMirrorApi           bool
+	MirrorApiPrefix           string
+	BigContextPrompt          string   // 用于大型上下文的自定义提示词
+	SingleLargeInputPrompt    string   // 大型上下文主要由一条用户消息组成时使用的提示词
+	BigContextOverflowPolicy  string   // 大型上下文文件超过 Claude 文件大小上限时的处理方式: error/truncate/split
+	GlobalSystemPrompt        string   // 添加到每个请求前的全局system提示词
+	MaxSystemTokens           int      // system 内容的最大 token 数，0 表示不限制
+	SystemPromptPriority      []string // system 内容的优先级，超出 MaxSystemTokens 时先截断优先级低的内容
+	AllowedImageMimeTypes     []string // 允许上传的图片 MIME 类型
+	MaxImagesPerRequest       int      // 每个请求最多上传的图片数量，0 表示不限制
+	MaxImageBytes             int      // 单张图片的最大字节数，0 表示不限制
+	AcceptCompressedImages    bool     // 解压 gzip/deflate 压缩的图片 data URI
+	LenientContentParsing     bool     // 宽松解析非标准客户端的内容格式
+	MaxEncodedContentDepth    int      // 宽松解析时 JSON 编码内容的最大解码次数
+	InvalidImagePolicy        string   // 无法解码的图片的处理方式: skip/error
+	ImagePositionInTurn       string   // 图片标记相对于本轮文本的位置: before/after/inline
+	KeepLatestImageOnly       bool     // 只上传最后一个带图片的用户消息中的图片
+	RequestValidations        []string // 处理请求后执行的检查: alternation/user_first/references/size/system
+	MaxPromptTokens           int      // 允许的最大提示词 token 数，0 表示不限制
+	WarnPromptTokens          int      // 提示词 token 数超过该值时输出警告，0 表示不警告
+	TrailingBlankUserPolicy   string   // 末尾空白用户消息的处理方式: drop/error
+	OversizedUserPolicy       string   // 提示词超过 MaxPromptTokens 时的处理方式: error/truncate
+	DebugPromptMode           string   // 调试日志中提示词的输出方式: off/preview/full
+	DebugPromptPreviewChars   int
+	PromptTeePath             string // 额外写入最终提示词的文件路径，用于离线分析
+	MergeContiguousSystemOnly bool   // 只合并相邻的system消息
+	MergeTrailingUserMessages bool   // 把末尾连续的用户消息合并为一条
+	FoldSystemIntoFirstUser   bool   // 把 system 内容放入第一条用户消息，不单独输出 System 轮次
+	RetryOnEmptyResponse      bool   // Claude 返回空回复时重试
+	EmptyResponseRetries      int    // 空回复的最大重试次数
+	MatchResponseLanguage     bool   // 根据最新的用户消息要求Claude使用相同语言回复
+	ConversationTitleMaxLen   int    // 会话标题的最大字符数，0 表示不设置标题
+	StreamReasoning           bool   // 通过 reasoning_content 字段返回思考过程
+	StreamFormat              string // 流式响应的格式: openai/anthropic
+	StripThinkingFromHistory  bool   // 去除历史 assistant 消息中的 <think> 思考块
+	CleanArtifactTags         bool   // 修复历史 assistant 消息中不完整的 <antArtifact> 标签
+	ThinkingStrippedMarker    string // 代替被去除的思考块的标记，为空时直接删除
+	EchoEffectiveConfig       bool   // 在 X-Effective-Config 响应头中返回请求实际生效的配置
+	RwMutx                    sync.RWMutex
 }
 
 // 解析 SESSION 格式的环境变量
@@ -72,6 +111,33 @@ func parseSessionEnv(envValue string) (int, []SessionInfo) {
 	return retryCount, sessions
 }
 
+// 解析逗号分隔的环境变量，忽略空项
+func parseListEnv(envValue string) []string {
+	var items []string
+	for _, item := range strings.Split(envValue, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, strings.ToLower(item))
+		}
+	}
+	return items
+}
+
+// 解析 system 内容优先级，忽略未知来源，未列出的来源排在最后
+func parseSystemPriority(envValue string) []string {
+	var priority []string
+	for _, source := range parseListEnv(envValue) {
+		if (source == "client" || source == "global") && !slices.Contains(priority, source) {
+			priority = append(priority, source)
+		}
+	}
+	for _, source := range []string{"client", "global"} {
+		if !slices.Contains(priority, source) {
+			priority = append(priority, source)
+		}
+	}
+	return priority
+}
+
 // 根据模型选择合适的 session
 func (c *Config) GetSessionForModel(idx int) (SessionInfo, error) {
 	if len(c.Sessions) == 0 || idx < 0 || idx >= len(c.Sessions) {
@@ -114,6 +180,66 @@ func LoadConfig() *Config {
 		maxContextMessages = 20 // 默认值
 	}
 
+	hardMaxMessages, err := strconv.Atoi(os.Getenv("HARD_MAX_MESSAGES"))
+	if err != nil {
+		hardMaxMessages = 0 // 默认不限制
+	}
+
+	emptyResponseRetries, err := strconv.Atoi(os.Getenv("EMPTY_RESPONSE_RETRIES"))
+	if err != nil || emptyResponseRetries < 0 {
+		emptyResponseRetries = 1 // 默认值
+	}
+
+	maxEncodedContentDepth, err := strconv.Atoi(os.Getenv("MAX_ENCODED_CONTENT_DEPTH"))
+	if err != nil || maxEncodedContentDepth < 0 {
+		maxEncodedContentDepth = 1 // 默认值
+	}
+
+	debugPromptPreviewChars, err := strconv.Atoi(os.Getenv("DEBUG_PROMPT_PREVIEW_CHARS"))
+	if err != nil {
+		debugPromptPreviewChars = 500 // 默认值
+	}
+
+	conversationTitleMaxLen, err := strconv.Atoi(os.Getenv("CONVERSATION_TITLE_MAX_LEN"))
+	if err != nil {
+		conversationTitleMaxLen = 50 // 默认值
+	}
+
+	bigContextImageBytes, err := strconv.Atoi(os.Getenv("BIG_CONTEXT_IMAGE_BYTES"))
+	if err != nil {
+		bigContextImageBytes = 0 // 默认不启用
+	}
+
+	maxImagesPerRequest, err := strconv.Atoi(os.Getenv("MAX_IMAGES_PER_REQUEST"))
+	if err != nil {
+		maxImagesPerRequest = 0 // 默认不限制
+	}
+
+	maxImageBytes, err := strconv.Atoi(os.Getenv("MAX_IMAGE_BYTES"))
+	if err != nil {
+		maxImageBytes = 0 // 默认不限制
+	}
+
+	allowedImageMimeTypes := parseListEnv(os.Getenv("ALLOWED_IMAGE_MIME_TYPES"))
+	if len(allowedImageMimeTypes) == 0 {
+		allowedImageMimeTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"} // 默认值
+	}
+
+	maxPromptTokens, err := strconv.Atoi(os.Getenv("MAX_PROMPT_TOKENS"))
+	if err != nil {
+		maxPromptTokens = 0 // 默认不限制
+	}
+
+	warnPromptTokens, err := strconv.Atoi(os.Getenv("WARN_PROMPT_TOKENS"))
+	if err != nil {
+		warnPromptTokens = 0 // 默认不警告
+	}
+
+	maxSystemTokens, err := strconv.Atoi(os.Getenv("MAX_SYSTEM_TOKENS"))
+	if err != nil {
+		maxSystemTokens = 0 // 默认不限制
+	}
+
 	retryCount, sessions := parseSessionEnv(os.Getenv("SESSIONS"))
 	config := &Config{
 		// 解析 SESSIONS 环境变量
@@ -129,12 +255,18 @@ func LoadConfig() *Config {
 		ChatDelete: os.Getenv("CHAT_DELETE") != "false",
 		// 设置最大聊天历史长度
 		MaxChatHistoryLength: maxChatHistoryLength,
+		// 设置使用文件上下文的图片总字节数阈值
+		BigContextImageBytes: bigContextImageBytes,
 		// 设置最大上下文消息数
 		MaxContextMessages: maxContextMessages,
+		// 设置 no_trim 请求的最大消息数
+		HardMaxMessages: hardMaxMessages,
 		// 设置重试次数
 		RetryCount: retryCount,
 		// 设置是否使用角色前缀
 		NoRolePrefix: os.Getenv("NO_ROLE_PREFIX") == "true",
+		// 设置是否在 Claude 续写出新的 Human 轮次时停止，默认开启
+		StopOnHumanTurn: os.Getenv("STOP_ON_HUMAN_TURN") != "false",
 		// 设置是否使用提示词禁用artifacts
 		PromptDisableArtifacts: os.Getenv("PROMPT_DISABLE_ARTIFACTS") == "true",
 		// 设置是否启用镜像API
@@ -143,6 +275,70 @@ func LoadConfig() *Config {
 		MirrorApiPrefix: os.Getenv("MIRROR_API_PREFIX"),
 		// 设置大型上下文提示词
 		BigContextPrompt: os.Getenv("BIG_CONTEXT_PROMPT"),
+		// 设置单条超长消息使用的提示词
+		SingleLargeInputPrompt: os.Getenv("SINGLE_LARGE_INPUT_PROMPT"),
+		// 设置全局system提示词
+		GlobalSystemPrompt: os.Getenv("GLOBAL_SYSTEM_PROMPT"),
+		// 设置 system 内容的最大 token 数
+		MaxSystemTokens: maxSystemTokens,
+		// 设置 system 内容的优先级
+		SystemPromptPriority: parseSystemPriority(os.Getenv("SYSTEM_PROMPT_PRIORITY")),
+		// 设置允许的图片 MIME 类型
+		AllowedImageMimeTypes: allowedImageMimeTypes,
+		// 设置图片数量和大小限制
+		MaxImagesPerRequest: maxImagesPerRequest,
+		MaxImageBytes:       maxImageBytes,
+		// 设置是否解压压缩的图片
+		AcceptCompressedImages: os.Getenv("ACCEPT_COMPRESSED_IMAGES") == "true",
+		// 设置是否宽松解析内容格式
+		LenientContentParsing:  os.Getenv("LENIENT_CONTENT_PARSING") == "true",
+		MaxEncodedContentDepth: maxEncodedContentDepth,
+		// 设置无法解码的图片的处理方式
+		InvalidImagePolicy: strings.ToLower(os.Getenv("INVALID_IMAGE_POLICY")),
+		// 设置图片标记在本轮中的位置
+		ImagePositionInTurn: strings.ToLower(os.Getenv("IMAGE_POSITION_IN_TURN")),
+		// 设置是否只保留最新一轮的图片
+		KeepLatestImageOnly: os.Getenv("KEEP_LATEST_IMAGE_ONLY") == "true",
+		// 设置是否单独返回思考过程
+		StreamReasoning: os.Getenv("STREAM_REASONING") == "true",
+		// 设置流式响应的格式
+		StreamFormat: strings.ToLower(os.Getenv("STREAM_FORMAT")),
+		// 设置是否去除历史中的思考过程
+		StripThinkingFromHistory: os.Getenv("STRIP_THINKING_FROM_HISTORY") == "true",
+		ThinkingStrippedMarker:   os.Getenv("THINKING_STRIPPED_MARKER"),
+		// 设置是否修复历史中的 artifact 标签
+		CleanArtifactTags: os.Getenv("CLEAN_ARTIFACT_TAGS") == "true",
+		// 设置是否返回实际生效的配置
+		EchoEffectiveConfig: os.Getenv("ECHO_EFFECTIVE_CONFIG") == "true",
+		// 设置请求检查
+		RequestValidations: parseListEnv(os.Getenv("REQUEST_VALIDATIONS")),
+		MaxPromptTokens:    maxPromptTokens,
+		WarnPromptTokens:   warnPromptTokens,
+		// 设置末尾空白用户消息的处理方式
+		TrailingBlankUserPolicy: strings.ToLower(os.Getenv("TRAILING_BLANK_USER_POLICY")),
+		// 设置超长用户消息的处理方式
+		OversizedUserPolicy: strings.ToLower(os.Getenv("OVERSIZED_USER_MESSAGE_POLICY")),
+		// 设置大型上下文文件超长时的处理方式
+		BigContextOverflowPolicy: strings.ToLower(os.Getenv("BIG_CONTEXT_OVERFLOW_POLICY")),
+		// 设置调试日志中提示词的输出方式
+		DebugPromptMode: strings.ToLower(os.Getenv("DEBUG_PROMPT_MODE")),
+		// 设置 preview 模式下输出的字符数
+		DebugPromptPreviewChars: debugPromptPreviewChars,
+		// 设置提示词副本的写入路径
+		PromptTeePath: os.Getenv("PROMPT_TEE_PATH"),
+		// 设置是否合并相邻的system消息
+		MergeContiguousSystemOnly: os.Getenv("MERGE_CONTIGUOUS_SYSTEM_ONLY") == "true",
+		// 设置是否合并末尾连续的用户消息
+		MergeTrailingUserMessages: os.Getenv("MERGE_TRAILING_USER_MESSAGES") == "true",
+		// 设置是否把system内容放入第一条用户消息
+		FoldSystemIntoFirstUser: os.Getenv("FOLD_SYSTEM_INTO_FIRST_USER") == "true",
+		// 设置空回复的重试
+		RetryOnEmptyResponse: os.Getenv("RETRY_ON_EMPTY_RESPONSE") == "true",
+		EmptyResponseRetries: emptyResponseRetries,
+		// 设置是否要求Claude使用用户的语言回复
+		MatchResponseLanguage: os.Getenv("MATCH_RESPONSE_LANGUAGE") == "true",
+		// 设置会话标题的最大长度
+		ConversationTitleMaxLen: conversationTitleMaxLen,
 		//设置读写锁
 		RwMutx: sync.RWMutex{},
 	}
@@ -156,6 +352,44 @@ func LoadConfig() *Config {
 	if config.BigContextPrompt == "" {
 		config.BigContextPrompt = "You must immerse yourself in the role of assistant in context.txt, cannot respond as a user, cannot reply to this message, cannot mention this message, and ignore this message in your response."
 	}
+	if config.SingleLargeInputPrompt == "" {
+		config.SingleLargeInputPrompt = "context.txt contains the user's message, which is mostly a large document. Read the whole document carefully and respond as the assistant to the request it contains. Do not mention this message or context.txt in your response."
+	}
+
+	// 未设置或无效时默认把图片标记放在文本之后
+	if config.ImagePositionInTurn != "before" && config.ImagePositionInTurn != "inline" {
+		config.ImagePositionInTurn = "after"
+	}
+
+	// 未设置或无效时默认跳过无法解码的图片
+	if config.InvalidImagePolicy != "error" {
+		config.InvalidImagePolicy = "skip"
+	}
+
+	// 未设置或无效时默认使用 OpenAI 格式的流式响应
+	if config.StreamFormat != "anthropic" {
+		config.StreamFormat = "openai"
+	}
+
+	// 未设置或无效时默认丢弃末尾的空白用户消息
+	if config.TrailingBlankUserPolicy != "error" {
+		config.TrailingBlankUserPolicy = "drop"
+	}
+
+	// 未设置或无效时默认不截断，返回错误
+	if config.OversizedUserPolicy != "truncate" {
+		config.OversizedUserPolicy = "error"
+	}
+
+	// 未设置或无效时默认拒绝超过文件大小上限的大型上下文
+	if config.BigContextOverflowPolicy != "truncate" && config.BigContextOverflowPolicy != "split" {
+		config.BigContextOverflowPolicy = "error"
+	}
+
+	// 未设置或无效时默认只输出提示词预览
+	if config.DebugPromptMode != "off" && config.DebugPromptMode != "full" {
+		config.DebugPromptMode = "preview"
+	}
 
 	return config
 }
@@ -182,10 +416,48 @@ func init() {
 	logger.Info(fmt.Sprintf("Proxy: %s", ConfigInstance.Proxy))
 	logger.Info(fmt.Sprintf("ChatDelete: %t", ConfigInstance.ChatDelete))
 	logger.Info(fmt.Sprintf("MaxChatHistoryLength: %d", ConfigInstance.MaxChatHistoryLength))
+	logger.Info(fmt.Sprintf("BigContextImageBytes: %d", ConfigInstance.BigContextImageBytes))
 	logger.Info(fmt.Sprintf("MaxContextMessages: %d", ConfigInstance.MaxContextMessages))
+	logger.Info(fmt.Sprintf("HardMaxMessages: %d", ConfigInstance.HardMaxMessages))
 	logger.Info(fmt.Sprintf("NoRolePrefix: %t", ConfigInstance.NoRolePrefix))
+	logger.Info(fmt.Sprintf("StopOnHumanTurn: %t", ConfigInstance.StopOnHumanTurn))
 	logger.Info(fmt.Sprintf("PromptDisableArtifacts: %t", ConfigInstance.PromptDisableArtifacts))
 	logger.Info(fmt.Sprintf("EnableMirrorApi: %t", ConfigInstance.EnableMirrorApi))
 	logger.Info(fmt.Sprintf("MirrorApiPrefix: %s", ConfigInstance.MirrorApiPrefix))
 	logger.Info(fmt.Sprintf("BigContextPrompt: %s", ConfigInstance.BigContextPrompt))
+	logger.Info(fmt.Sprintf("SingleLargeInputPrompt: %s", ConfigInstance.SingleLargeInputPrompt))
+	logger.Info(fmt.Sprintf("GlobalSystemPrompt: %s", ConfigInstance.GlobalSystemPrompt))
+	logger.Info(fmt.Sprintf("MaxSystemTokens: %d", ConfigInstance.MaxSystemTokens))
+	logger.Info(fmt.Sprintf("SystemPromptPriority: %v", ConfigInstance.SystemPromptPriority))
+	logger.Info(fmt.Sprintf("AllowedImageMimeTypes: %v", ConfigInstance.AllowedImageMimeTypes))
+	logger.Info(fmt.Sprintf("MaxImagesPerRequest: %d", ConfigInstance.MaxImagesPerRequest))
+	logger.Info(fmt.Sprintf("MaxImageBytes: %d", ConfigInstance.MaxImageBytes))
+	logger.Info(fmt.Sprintf("AcceptCompressedImages: %v", ConfigInstance.AcceptCompressedImages))
+	logger.Info(fmt.Sprintf("LenientContentParsing: %t", ConfigInstance.LenientContentParsing))
+	logger.Info(fmt.Sprintf("MaxEncodedContentDepth: %d", ConfigInstance.MaxEncodedContentDepth))
+	logger.Info(fmt.Sprintf("InvalidImagePolicy: %s", ConfigInstance.InvalidImagePolicy))
+	logger.Info(fmt.Sprintf("ImagePositionInTurn: %s", ConfigInstance.ImagePositionInTurn))
+	logger.Info(fmt.Sprintf("KeepLatestImageOnly: %v", ConfigInstance.KeepLatestImageOnly))
+	logger.Info(fmt.Sprintf("RequestValidations: %v", ConfigInstance.RequestValidations))
+	logger.Info(fmt.Sprintf("MaxPromptTokens: %d", ConfigInstance.MaxPromptTokens))
+	logger.Info(fmt.Sprintf("WarnPromptTokens: %d", ConfigInstance.WarnPromptTokens))
+	logger.Info(fmt.Sprintf("StreamReasoning: %v", ConfigInstance.StreamReasoning))
+	logger.Info(fmt.Sprintf("StreamFormat: %s", ConfigInstance.StreamFormat))
+	logger.Info(fmt.Sprintf("StripThinkingFromHistory: %v", ConfigInstance.StripThinkingFromHistory))
+	logger.Info(fmt.Sprintf("CleanArtifactTags: %v", ConfigInstance.CleanArtifactTags))
+	logger.Info(fmt.Sprintf("ThinkingStrippedMarker: %s", ConfigInstance.ThinkingStrippedMarker))
+	logger.Info(fmt.Sprintf("EchoEffectiveConfig: %v", ConfigInstance.EchoEffectiveConfig))
+	logger.Info(fmt.Sprintf("TrailingBlankUserPolicy: %s", ConfigInstance.TrailingBlankUserPolicy))
+	logger.Info(fmt.Sprintf("OversizedUserPolicy: %s", ConfigInstance.OversizedUserPolicy))
+	logger.Info(fmt.Sprintf("BigContextOverflowPolicy: %s", ConfigInstance.BigContextOverflowPolicy))
+	logger.Info(fmt.Sprintf("DebugPromptMode: %s", ConfigInstance.DebugPromptMode))
+	logger.Info(fmt.Sprintf("DebugPromptPreviewChars: %d", ConfigInstance.DebugPromptPreviewChars))
+	logger.Info(fmt.Sprintf("PromptTeePath: %s", ConfigInstance.PromptTeePath))
+	logger.Info(fmt.Sprintf("MergeContiguousSystemOnly: %t", ConfigInstance.MergeContiguousSystemOnly))
+	logger.Info(fmt.Sprintf("MergeTrailingUserMessages: %t", ConfigInstance.MergeTrailingUserMessages))
+	logger.Info(fmt.Sprintf("FoldSystemIntoFirstUser: %t", ConfigInstance.FoldSystemIntoFirstUser))
+	logger.Info(fmt.Sprintf("RetryOnEmptyResponse: %t", ConfigInstance.RetryOnEmptyResponse))
+	logger.Info(fmt.Sprintf("EmptyResponseRetries: %d", ConfigInstance.EmptyResponseRetries))
+	logger.Info(fmt.Sprintf("MatchResponseLanguage: %t", ConfigInstance.MatchResponseLanguage))
+	logger.Info(fmt.Sprintf("ConversationTitleMaxLen: %d", ConfigInstance.ConversationTitleMaxLen))
 }
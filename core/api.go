@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"claude2api/logger"
 	"claude2api/model"
+	"claude2api/utils"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -19,20 +20,44 @@ import (
 )
 
 type Client struct {
-	SessionKey   string
-	orgID        string
-	client       *req.Client
-	defaultAttrs map[string]interface{}
+	SessionKey    string
+	orgID         string
+	client        *req.Client
+	defaultAttrs  map[string]interface{}
+	stopSequences []string
+	maxTokens     int
+	// 通过 reasoning_content 返回思考过程，而不是写入 <think> 标签
+	streamReasoning bool
+	// 估算的提示词 token 数，Claude 没有返回 usage 时使用
+	promptTokens int
+	// Claude 返回空回复时不向客户端输出，返回 ErrEmptyResponse 以便重试
+	failOnEmpty bool
+	// 流式响应的格式: openai/anthropic
+	streamFormat string
+}
+
+// ErrEmptyResponse Claude 返回了空回复
+var ErrEmptyResponse = errors.New("empty response from Claude")
+
+type eventUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
 }
 
 type ResponseEvent struct {
 	Type  string `json:"type"`
 	Index int    `json:"index"`
 	Delta struct {
-		Type     string `json:"type"`
-		Text     string `json:"text"`
-		THINKING string `json:"thinking"`
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		THINKING   string `json:"thinking"`
+		StopReason string `json:"stop_reason"`
 	} `json:"delta"`
+	// message_start 事件中的输入 token 数和 message_delta 事件中的输出 token 数
+	Message struct {
+		Usage eventUsage `json:"usage"`
+	} `json:"message"`
+	Usage eventUsage `json:"usage"`
 	Error struct {
 		Message string `json:"message"`
 	} `json:"error"`
@@ -99,6 +124,37 @@ func NewClient(sessionKey string, proxy string) *Client {
 func (c *Client) SetOrgID(orgID string) {
 	c.orgID = orgID
 }
+
+// SetStopSequences sets the sequences that end the response when Claude emits them
+func (c *Client) SetStopSequences(stops []string) {
+	c.stopSequences = stops
+}
+
+// SetMaxTokens caps the estimated length of the response text, 0 means no cap
+func (c *Client) SetMaxTokens(maxTokens int) {
+	c.maxTokens = maxTokens
+}
+
+// SetStreamReasoning 设置是否通过 reasoning_content 字段单独返回思考过程
+func (c *Client) SetStreamReasoning(enabled bool) {
+	c.streamReasoning = enabled
+}
+
+// SetPromptTokens 设置估算的提示词 token 数
+func (c *Client) SetPromptTokens(tokens int) {
+	c.promptTokens = tokens
+}
+
+// SetFailOnEmpty 设置空回复时是否返回 ErrEmptyResponse 而不是向客户端返回空回复
+func (c *Client) SetFailOnEmpty(enabled bool) {
+	c.failOnEmpty = enabled
+}
+
+// SetStreamFormat 设置流式响应的格式，anthropic 使用 Anthropic 原生 SSE 事件，其他值使用 OpenAI 格式
+func (c *Client) SetStreamFormat(format string) {
+	c.streamFormat = format
+}
+
 func (c *Client) GetOrgID() (string, error) {
 	url := "https://claude.ai/api/organizations"
 	resp, err := c.client.R().
@@ -136,8 +192,8 @@ func (c *Client) GetOrgID() (string, error) {
 
 }
 
-// CreateConversation creates a new conversation and returns its UUID
-func (c *Client) CreateConversation(model string) (string, error) {
+// CreateConversation creates a new conversation with the given name and returns its UUID
+func (c *Client) CreateConversation(model string, name string) (string, error) {
 	if c.orgID == "" {
 		return "", errors.New("organization ID not set")
 	}
@@ -146,7 +202,7 @@ func (c *Client) CreateConversation(model string) (string, error) {
 	requestBody := map[string]interface{}{
 		"model":                            model,
 		"uuid":                             uuid.New().String(),
-		"name":                             "",
+		"name":                             name,
 		"include_conversation_preferences": true,
 	}
 	if len(model) > 6 && model[len(model)-6:] == "-think" {
@@ -210,7 +266,13 @@ func (c *Client) SendMessage(conversationID string, message string, stream bool,
 func (c *Client) HandleResponse(body io.ReadCloser, stream bool, gc *gin.Context) error {
 	defer body.Close()
 	// Set headers for streaming
-	if stream {
+	// 收到第一段内容时才开始输出，空回复需要重试时客户端不会收到任何数据
+	streamStarted := false
+	begin := func() {
+		if !stream || streamStarted {
+			return
+		}
+		streamStarted = true
 		gc.Writer.Header().Set("Content-Type", "text/event-stream")
 		gc.Writer.Header().Set("Cache-Control", "no-cache")
 		gc.Writer.Header().Set("Connection", "keep-alive")
@@ -218,11 +280,18 @@ func (c *Client) HandleResponse(body io.ReadCloser, stream bool, gc *gin.Context
 		gc.Writer.WriteHeader(http.StatusOK)
 		gc.Writer.Flush()
 	}
+	out := c.newStreamOutput(gc)
 	scanner := bufio.NewScanner(body)
 	clientDone := gc.Request.Context().Done()
 	// Keep track of the full response for the final message
 	thinkingShown := false
 	res_all_text := ""
+	reasoning_text := ""
+	finishReason := "stop"
+	usage := &usageTracker{}
+	stopper := newStopFilter(c.stopSequences)
+	trimmer := &leadingTrimmer{}
+	limiter := newTokenLimiter(c.maxTokens)
 	for scanner.Scan() {
 		select {
 		case <-clientDone:
@@ -241,20 +310,49 @@ func (c *Client) HandleResponse(body io.ReadCloser, stream bool, gc *gin.Context
 		var event ResponseEvent
 		if err := json.Unmarshal([]byte(data), &event); err == nil {
 			if event.Type == "error" && event.Error.Message != "" {
-				model.ReturnOpenAIResponse(event.Error.Message, stream, gc)
+				if stream {
+					begin()
+					out.Error(event.Error.Message)
+				} else {
+					model.ReturnOpenAIResponse(event.Error.Message, stream, gc)
+				}
 				return nil
 			}
 			if event.Delta.Type == "text_delta" && event.Delta.Text != "" {
-				res_text := event.Delta.Text
+				res_text, stopped := stopper.Feed(event.Delta.Text)
+				res_text, limited := limiter.Limit(trimmer.Trim(res_text))
 				if thinkingShown {
 					res_text = "</think>\n" + res_text
 					thinkingShown = false
 				}
 				res_all_text += res_text
-				if !stream {
-					continue
+				if stream && res_text != "" {
+					begin()
+					out.Text(res_text)
+				}
+				if stopped {
+					logger.Info("Stop sequence reached, ending response")
+					break
+				}
+				if limited {
+					logger.Info(fmt.Sprintf("max_tokens (%d) reached, ending response", c.maxTokens))
+					finishReason = "length"
+					break
+				}
+				continue
+			}
+			usage.Observe(event.Message.Usage)
+			usage.Observe(event.Usage)
+			if event.Type == "message_delta" && event.Delta.StopReason != "" {
+				finishReason = openAIFinishReason(event.Delta.StopReason)
+				continue
+			}
+			if event.Delta.Type == "thinking_delta" && c.streamReasoning {
+				reasoning_text += event.Delta.THINKING
+				if stream && event.Delta.THINKING != "" {
+					begin()
+					out.Reasoning(event.Delta.THINKING)
 				}
-				model.ReturnOpenAIResponse(res_text, stream, gc)
 				continue
 			}
 			if event.Delta.Type == "thinking_delta" {
@@ -267,7 +365,8 @@ func (c *Client) HandleResponse(body io.ReadCloser, stream bool, gc *gin.Context
 				if !stream {
 					continue
 				}
-				model.ReturnOpenAIResponse(res_text, stream, gc)
+				begin()
+				out.Text(res_text)
 				continue
 			}
 		}
@@ -275,12 +374,22 @@ func (c *Client) HandleResponse(body io.ReadCloser, stream bool, gc *gin.Context
 	if err := scanner.Err(); err != nil {
 		return fmt.Errorf("error reading response: %w", err)
 	}
+	if rest, _ := limiter.Limit(trimmer.Trim(stopper.Flush())); rest != "" {
+		res_all_text += rest
+		if stream {
+			begin()
+			out.Text(rest)
+		}
+	}
+	if c.failOnEmpty && res_all_text == "" && reasoning_text == "" {
+		return ErrEmptyResponse
+	}
+	reportedUsage := usage.Usage(c.promptTokens, utils.EstimateTextTokens(reasoning_text+res_all_text))
 	if !stream {
-		model.ReturnOpenAIResponse(res_all_text, stream, gc)
+		model.ReturnOpenAICompletion(res_all_text, reasoning_text, finishReason, reportedUsage, gc)
 	} else {
-		// 发送结束标志
-		gc.Writer.Write([]byte("data: [DONE]\n\n"))
-		gc.Writer.Flush()
+		begin()
+		out.Finish(finishReason, reportedUsage)
 	}
 
 	return nil
@@ -362,6 +471,10 @@ func (c *Client) UploadFile(fileData []string) error {
 			filename = "image.jpg"
 		case "image/png":
 			filename = "image.png"
+		case "image/gif":
+			filename = "image.gif"
+		case "image/webp":
+			filename = "image.webp"
 		case "application/pdf":
 			filename = "document.pdf"
 		default:
@@ -407,14 +520,16 @@ func (c *Client) UploadFile(fileData []string) error {
 	return nil
 }
 
-func (c *Client) SetBigContext(context string) {
-	c.defaultAttrs["attachments"] = []map[string]interface{}{
-		{
-			"file_name":         "context.txt",
+// SetBigContext 把大型上下文作为文本附件发送，多个文件依次命名为 context.txt、context_2.txt ...
+func (c *Client) SetBigContext(documents []string) {
+	attachments := make([]map[string]interface{}, 0, len(documents))
+	for i, document := range documents {
+		attachments = append(attachments, map[string]interface{}{
+			"file_name":         utils.BigContextFileName(i),
 			"file_type":         "text/plain",
-			"file_size":         len(context),
-			"extracted_content": context,
-		},
+			"file_size":         len(document),
+			"extracted_content": document,
+		})
 	}
-
+	c.defaultAttrs["attachments"] = attachments
 }
@@ -0,0 +1,197 @@
+package core
+
+import (
+	"claude2api/model"
+	"errors"
+	"testing"
+)
+
+func TestStreamReasoning(t *testing.T) {
+	events := []string{thinkingDelta("Let me think."), thinkingDelta(" Done."), textDelta("Hello")}
+	tests := []struct {
+		name          string
+		reasoning     bool
+		wantContent   string
+		wantReasoning string
+	}{
+		{"think tags", false, "<think>Let me think. Done.</think>\nHello", ""},
+		{"reasoning_content", true, "Hello", "Let me think. Done."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" stream", func(t *testing.T) {
+			c := &Client{}
+			c.SetStreamReasoning(tt.reasoning)
+			w, err := handle(t, c, true, events...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chunks := streamChunks(t, w.Body.String())
+			reasoning := ""
+			for _, chunk := range chunks {
+				delta := chunk.Choices[0].Delta
+				if delta.Content != "" && delta.ReasoningContent != "" {
+					t.Errorf("chunk mixes content %q and reasoning %q", delta.Content, delta.ReasoningContent)
+				}
+				reasoning += delta.ReasoningContent
+			}
+			if got := streamText(chunks); got != tt.wantContent {
+				t.Errorf("content = %q, want %q", got, tt.wantContent)
+			}
+			if reasoning != tt.wantReasoning {
+				t.Errorf("reasoning = %q, want %q", reasoning, tt.wantReasoning)
+			}
+		})
+		t.Run(tt.name+" non-stream", func(t *testing.T) {
+			c := &Client{}
+			c.SetStreamReasoning(tt.reasoning)
+			w, err := handle(t, c, false, events...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			message := completion(t, w.Body.String()).Choices[0].Message
+			if message.Content != tt.wantContent || message.ReasoningContent != tt.wantReasoning {
+				t.Errorf("message = %q, %q, want %q, %q", message.Content, message.ReasoningContent, tt.wantContent, tt.wantReasoning)
+			}
+		})
+	}
+}
+
+func TestFinishReason(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxTokens int
+		events    []string
+		want      string
+	}{
+		{"end_turn", 0, []string{textDelta("Hello"), messageDelta("end_turn", 1)}, "stop"},
+		{"stop_sequence", 0, []string{textDelta("Hello"), messageDelta("stop_sequence", 1)}, "stop"},
+		{"claude max_tokens", 0, []string{textDelta("Hello"), messageDelta("max_tokens", 1)}, "length"},
+		{"refusal", 0, []string{textDelta("Sorry"), messageDelta("refusal", 1)}, "content_filter"},
+		{"tool_use", 0, []string{textDelta("Calling"), messageDelta("tool_use", 1)}, "stop"},
+		{"no stop reason", 0, []string{textDelta("Hello")}, "stop"},
+		{"client max_tokens reached", 1, []string{textDelta("Hello world, this is long"), messageDelta("end_turn", 5)}, "length"},
+		{"client max_tokens used exactly", 2, []string{textDelta("Hello wo"), messageDelta("end_turn", 2)}, "stop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" stream", func(t *testing.T) {
+			c := &Client{}
+			c.SetMaxTokens(tt.maxTokens)
+			w, err := handle(t, c, true, tt.events...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chunks := streamChunks(t, w.Body.String())
+			last := chunks[len(chunks)-1].Choices[0]
+			if last.FinishReason != tt.want {
+				t.Errorf("finish_reason = %v, want %q", last.FinishReason, tt.want)
+			}
+			for _, chunk := range chunks[:len(chunks)-1] {
+				if chunk.Choices[0].FinishReason != nil {
+					t.Errorf("finish_reason %v sent before the last chunk", chunk.Choices[0].FinishReason)
+				}
+			}
+		})
+		t.Run(tt.name+" non-stream", func(t *testing.T) {
+			c := &Client{}
+			c.SetMaxTokens(tt.maxTokens)
+			w, err := handle(t, c, false, tt.events...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := completion(t, w.Body.String()).Choices[0].FinishReason; got != tt.want {
+				t.Errorf("finish_reason = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUsage(t *testing.T) {
+	text := textDelta("Hello world!")
+	tests := []struct {
+		name   string
+		events []string
+		want   model.Usage
+	}{
+		{"reported by Claude", []string{messageStart(12), text, messageDelta("end_turn", 7)}, model.Usage{PromptTokens: 12, CompletionTokens: 7, TotalTokens: 19}},
+		{"latest output count wins", []string{messageStart(12), text, messageDelta("", 3), messageDelta("end_turn", 7)}, model.Usage{PromptTokens: 12, CompletionTokens: 7, TotalTokens: 19}},
+		{"estimated when missing", []string{text}, model.Usage{PromptTokens: 30, CompletionTokens: 3, TotalTokens: 33}},
+		{"only input reported", []string{messageStart(12), text}, model.Usage{PromptTokens: 12, CompletionTokens: 3, TotalTokens: 15}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" stream", func(t *testing.T) {
+			c := &Client{}
+			c.SetPromptTokens(30)
+			w, err := handle(t, c, true, tt.events...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chunks := streamChunks(t, w.Body.String())
+			last := chunks[len(chunks)-1]
+			if last.Usage == nil || *last.Usage != tt.want {
+				t.Errorf("usage = %+v, want %+v", last.Usage, tt.want)
+			}
+		})
+		t.Run(tt.name+" non-stream", func(t *testing.T) {
+			c := &Client{}
+			c.SetPromptTokens(30)
+			w, err := handle(t, c, false, tt.events...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := completion(t, w.Body.String()).Usage; got != tt.want {
+				t.Errorf("usage = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryOnEmptyResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream bool
+	}{
+		{"stream", true},
+		{"non-stream", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gc, w := newGinContext()
+			c := &Client{}
+
+			// 第一次为空回复，需要重试时不能向客户端写入任何内容
+			c.SetFailOnEmpty(true)
+			err := c.HandleResponse(sseBody(textDelta(""), messageDelta("end_turn", 0)), tt.stream, gc)
+			if !errors.Is(err, ErrEmptyResponse) {
+				t.Fatalf("first attempt error = %v, want ErrEmptyResponse", err)
+			}
+			if w.Body.Len() != 0 {
+				t.Fatalf("empty attempt wrote %q", w.Body.String())
+			}
+
+			// 最后一次尝试照常返回
+			c.SetFailOnEmpty(false)
+			if err := c.HandleResponse(sseBody(textDelta("Hello"), messageDelta("end_turn", 1)), tt.stream, gc); err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if tt.stream {
+				got = streamText(streamChunks(t, w.Body.String()))
+			} else {
+				got = completion(t, w.Body.String()).Choices[0].Message.Content
+			}
+			if got != "Hello" {
+				t.Errorf("response = %q, want %q", got, "Hello")
+			}
+		})
+	}
+}
+
+func TestEmptyResponseWithoutRetry(t *testing.T) {
+	w, err := handle(t, &Client{}, false, messageDelta("end_turn", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := completion(t, w.Body.String()).Choices[0].Message.Content; got != "" {
+		t.Errorf("response = %q, want an empty answer", got)
+	}
+}
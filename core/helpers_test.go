@@ -0,0 +1,109 @@
+package core
+
+import (
+	"claude2api/model"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// claudeEvent 把 Claude 的 SSE 事件编码为 JSON
+func claudeEvent(event map[string]interface{}) string {
+	data, _ := json.Marshal(event)
+	return string(data)
+}
+
+func textDelta(text string) string {
+	return claudeEvent(map[string]interface{}{"type": "content_block_delta", "delta": map[string]interface{}{"type": "text_delta", "text": text}})
+}
+
+func thinkingDelta(text string) string {
+	return claudeEvent(map[string]interface{}{"type": "content_block_delta", "delta": map[string]interface{}{"type": "thinking_delta", "thinking": text}})
+}
+
+func messageStart(inputTokens int) string {
+	return claudeEvent(map[string]interface{}{"type": "message_start", "message": map[string]interface{}{"usage": map[string]interface{}{"input_tokens": inputTokens}}})
+}
+
+func messageDelta(stopReason string, outputTokens int) string {
+	return claudeEvent(map[string]interface{}{"type": "message_delta", "delta": map[string]interface{}{"stop_reason": stopReason}, "usage": map[string]interface{}{"output_tokens": outputTokens}})
+}
+
+// sseBody 把事件编码为 Claude 的 SSE 响应体
+func sseBody(events ...string) io.ReadCloser {
+	var body strings.Builder
+	for _, event := range events {
+		body.WriteString("event: message\ndata: " + event + "\n\n")
+	}
+	return io.NopCloser(strings.NewReader(body.String()))
+}
+
+// newGinContext 创建写入 ResponseRecorder 的 gin 上下文
+func newGinContext() (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	gc, _ := gin.CreateTestContext(w)
+	gc.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	return gc, w
+}
+
+// handle 把事件作为 Claude 的 SSE 响应交给 HandleResponse，返回写给客户端的响应
+func handle(t *testing.T, c *Client, stream bool, events ...string) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+	gc, w := newGinContext()
+	err := c.HandleResponse(sseBody(events...), stream, gc)
+	return w, err
+}
+
+// streamChunks 解析 OpenAI 格式的流式响应，确认以 [DONE] 结束
+func streamChunks(t *testing.T, body string) []model.OpenAISrteamResponse {
+	t.Helper()
+	var chunks []model.OpenAISrteamResponse
+	done := false
+	for _, line := range strings.Split(body, "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			done = true
+			continue
+		}
+		var chunk model.OpenAISrteamResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	if !done {
+		t.Errorf("stream did not end with [DONE]: %q", body)
+	}
+	return chunks
+}
+
+// streamText 返回流式响应中 content 的拼接结果
+func streamText(chunks []model.OpenAISrteamResponse) string {
+	var text strings.Builder
+	for _, chunk := range chunks {
+		text.WriteString(chunk.Choices[0].Delta.Content)
+	}
+	return text.String()
+}
+
+// completion 解析非流式响应
+func completion(t *testing.T, body string) model.OpenAIResponse {
+	t.Helper()
+	var resp model.OpenAIResponse
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("invalid completion %q: %v", body, err)
+	}
+	return resp
+}
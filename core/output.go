@@ -0,0 +1,50 @@
+package core
+
+import (
+	"claude2api/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// streamOutput 流式响应的输出格式
+type streamOutput interface {
+	Text(text string) error
+	Reasoning(text string) error
+	Error(message string) error
+	Finish(finishReason string, usage model.Usage) error
+}
+
+// openAIOutput 以 OpenAI chat.completion.chunk 格式输出
+type openAIOutput struct {
+	gc *gin.Context
+}
+
+func (o *openAIOutput) Text(text string) error {
+	return model.ReturnOpenAIResponse(text, true, o.gc)
+}
+
+func (o *openAIOutput) Reasoning(text string) error {
+	return model.ReturnOpenAIReasoning(text, o.gc)
+}
+
+func (o *openAIOutput) Error(message string) error {
+	return model.ReturnOpenAIResponse(message, true, o.gc)
+}
+
+func (o *openAIOutput) Finish(finishReason string, usage model.Usage) error {
+	if err := model.ReturnOpenAIFinish(finishReason, usage, o.gc); err != nil {
+		return err
+	}
+	// 发送结束标志
+	o.gc.Writer.Write([]byte("data: [DONE]\n\n"))
+	o.gc.Writer.Flush()
+	return nil
+}
+
+// newStreamOutput 根据 streamFormat 创建流式输出
+func (c *Client) newStreamOutput(gc *gin.Context) streamOutput {
+	if c.streamFormat == "anthropic" {
+		return model.NewAnthropicStream(gc, c.promptTokens)
+	}
+	return &openAIOutput{gc: gc}
+}
@@ -0,0 +1,93 @@
+package core
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// anthropicEvent Anthropic 格式流式响应中的一个事件
+type anthropicEvent struct {
+	name string
+	data map[string]interface{}
+}
+
+// anthropicEvents 解析 Anthropic 格式的流式响应
+func anthropicEvents(t *testing.T, body string) []anthropicEvent {
+	t.Helper()
+	var events []anthropicEvent
+	for _, block := range strings.Split(strings.TrimSpace(body), "\n\n") {
+		name, data, ok := strings.Cut(block, "\n")
+		if !ok || !strings.HasPrefix(name, "event: ") || !strings.HasPrefix(data, "data: ") {
+			t.Fatalf("invalid event %q", block)
+		}
+		event := anthropicEvent{name: strings.TrimPrefix(name, "event: ")}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &event.data); err != nil {
+			t.Fatalf("invalid event data %q: %v", data, err)
+		}
+		if event.data["type"] != event.name {
+			t.Errorf("event %s has type %v", event.name, event.data["type"])
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestAnthropicStreamFormat(t *testing.T) {
+	tests := []struct {
+		name       string
+		events     []string
+		wantEvents []string
+		wantStop   string
+		wantBlocks []string
+	}{
+		{"text only", []string{textDelta("Hello"), textDelta(" there"), messageDelta("end_turn", 2)},
+			[]string{"message_start", "content_block_start", "content_block_delta", "content_block_delta", "content_block_stop", "message_delta", "message_stop"},
+			"end_turn", []string{"text"}},
+		{"thinking then text", []string{thinkingDelta("Plan."), textDelta("Hello"), messageDelta("max_tokens", 2)},
+			[]string{"message_start", "content_block_start", "content_block_delta", "content_block_stop", "content_block_start", "content_block_delta", "content_block_stop", "message_delta", "message_stop"},
+			"max_tokens", []string{"thinking", "text"}},
+		{"empty response", []string{messageDelta("end_turn", 0)},
+			[]string{"message_start", "message_delta", "message_stop"},
+			"end_turn", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{}
+			c.SetStreamFormat("anthropic")
+			c.SetStreamReasoning(true)
+			w, err := handle(t, c, true, tt.events...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(w.Body.String(), "[DONE]") {
+				t.Errorf("anthropic stream contains [DONE]")
+			}
+
+			events := anthropicEvents(t, w.Body.String())
+			var names, blocks []string
+			for i, event := range events {
+				names = append(names, event.name)
+				switch event.name {
+				case "content_block_start":
+					block := event.data["content_block"].(map[string]interface{})
+					blocks = append(blocks, block["type"].(string))
+					if index := event.data["index"]; index != float64(len(blocks)-1) {
+						t.Errorf("event %d: block index = %v, want %d", i, index, len(blocks)-1)
+					}
+				case "message_delta":
+					if stop := event.data["delta"].(map[string]interface{})["stop_reason"]; stop != tt.wantStop {
+						t.Errorf("stop_reason = %v, want %q", stop, tt.wantStop)
+					}
+				}
+			}
+			if !reflect.DeepEqual(names, tt.wantEvents) {
+				t.Errorf("events = %v, want %v", names, tt.wantEvents)
+			}
+			if !reflect.DeepEqual(blocks, tt.wantBlocks) {
+				t.Errorf("content blocks = %v, want %v", blocks, tt.wantBlocks)
+			}
+		})
+	}
+}
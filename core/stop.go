@@ -0,0 +1,54 @@
+package core
+
+import "strings"
+
+// stopFilter 在流式输出中检测停止词，命中后截断后续内容
+type stopFilter struct {
+	stops   []string
+	pending string
+	stopped bool
+}
+
+func newStopFilter(stops []string) *stopFilter {
+	return &stopFilter{stops: stops}
+}
+
+// Feed 传入新的文本片段，返回可以安全输出的部分以及是否命中停止词
+// 可能构成停止词前缀的结尾部分会被暂存，等待下一个片段再判断
+func (f *stopFilter) Feed(text string) (string, bool) {
+	if f.stopped {
+		return "", true
+	}
+	buf := f.pending + text
+	f.pending = ""
+
+	cut := -1
+	for _, stop := range f.stops {
+		if idx := strings.Index(buf, stop); idx >= 0 && (cut < 0 || idx < cut) {
+			cut = idx
+		}
+	}
+	if cut >= 0 {
+		f.stopped = true
+		return buf[:cut], true
+	}
+
+	hold := 0
+	for _, stop := range f.stops {
+		for k := len(stop) - 1; k > hold; k-- {
+			if strings.HasSuffix(buf, stop[:k]) {
+				hold = k
+				break
+			}
+		}
+	}
+	f.pending = buf[len(buf)-hold:]
+	return buf[:len(buf)-hold], false
+}
+
+// Flush 返回流结束时仍暂存的文本
+func (f *stopFilter) Flush() string {
+	text := f.pending
+	f.pending = ""
+	return text
+}
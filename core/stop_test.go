@@ -0,0 +1,47 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStopFilter(t *testing.T) {
+	tests := []struct {
+		name        string
+		stops       []string
+		chunks      []string
+		want        string
+		wantStopped bool
+	}{
+		{"no stop", []string{"\nHuman:"}, []string{"Hello", " world"}, "Hello world", false},
+		{"stop in one chunk", []string{"\nHuman:"}, []string{"Hi\nHuman: more"}, "Hi", true},
+		{"stop across chunks", []string{"\nHuman:"}, []string{"Hi\nHu", "man: more"}, "Hi", true},
+		{"stop split into single characters", []string{"END"}, []string{"ok E", "N", "D!"}, "ok ", true},
+		{"held prefix released", []string{"\nHuman:"}, []string{"Hi\nHu", "go"}, "Hi\nHugo", false},
+		{"prefix at end of stream", []string{"\nHuman:"}, []string{"Hi\nHum"}, "Hi\nHum", false},
+		{"earliest of overlapping stops", []string{"\nHuman:", "an:"}, []string{"Hi\nHum", "an: x"}, "Hi", true},
+		{"client stop before role prefix", []string{"\nHuman:", "STOP"}, []string{"a STOP\nHuman:"}, "a ", true},
+		{"client stop inside role prefix", []string{"\nHuman:", "Human:"}, []string{"Sure.\nHuman: next"}, "Sure.", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newStopFilter(tt.stops)
+			var out strings.Builder
+			stopped := false
+			for _, chunk := range tt.chunks {
+				text, hit := f.Feed(chunk)
+				out.WriteString(text)
+				if hit {
+					stopped = true
+					break
+				}
+			}
+			if !stopped {
+				out.WriteString(f.Flush())
+			}
+			if out.String() != tt.want || stopped != tt.wantStopped {
+				t.Errorf("output = %q, stopped = %v, want %q, %v", out.String(), stopped, tt.want, tt.wantStopped)
+			}
+		})
+	}
+}
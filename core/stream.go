@@ -0,0 +1,90 @@
+package core
+
+import (
+	"claude2api/model"
+	"strings"
+)
+
+// leadingTrimmer 去除回复开头的空白和换行，遇到第一个非空白字符后原样输出
+type leadingTrimmer struct {
+	started bool
+}
+
+// Trim 处理一个文本片段，回复开始前的纯空白片段会返回空字符串
+func (t *leadingTrimmer) Trim(text string) string {
+	if t.started {
+		return text
+	}
+	text = strings.TrimLeft(text, " \t\r\n")
+	if text != "" {
+		t.started = true
+	}
+	return text
+}
+
+// tokenLimiter 按每 4 个字符约 1 个 token 估算回复长度，达到 max_tokens 后截断
+type tokenLimiter struct {
+	maxChars  int
+	usedChars int
+}
+
+func newTokenLimiter(maxTokens int) *tokenLimiter {
+	return &tokenLimiter{maxChars: maxTokens * 4}
+}
+
+// Limit 返回预算内的文本以及文本是否被截断，maxTokens 为 0 时不限制
+// 恰好用完预算的文本不算截断，之后再有文本时才返回 true
+func (l *tokenLimiter) Limit(text string) (string, bool) {
+	if l.maxChars <= 0 {
+		return text, false
+	}
+	runes := []rune(text)
+	remaining := l.maxChars - l.usedChars
+	if len(runes) <= remaining {
+		l.usedChars += len(runes)
+		return text, false
+	}
+	l.usedChars = l.maxChars
+	return string(runes[:remaining]), true
+}
+
+// openAIFinishReason 把 Claude 的 stop_reason 转换为 OpenAI 的 finish_reason
+func openAIFinishReason(stopReason string) string {
+	switch stopReason {
+	case "max_tokens":
+		return "length"
+	case "refusal":
+		return "content_filter"
+	default:
+		return "stop"
+	}
+}
+
+// usageTracker 记录 Claude 在 SSE 中返回的 token 数
+type usageTracker struct {
+	inputTokens  int
+	outputTokens int
+}
+
+// Observe 记录事件中的 usage，输出 token 数在流中累计，取最新的值
+func (u *usageTracker) Observe(usage eventUsage) {
+	if usage.InputTokens > 0 {
+		u.inputTokens = usage.InputTokens
+	}
+	if usage.OutputTokens > 0 {
+		u.outputTokens = usage.OutputTokens
+	}
+}
+
+// Usage 返回 OpenAI 格式的 usage，Claude 没有返回的部分使用估算值
+func (u *usageTracker) Usage(estimatedPrompt int, estimatedCompletion int) model.Usage {
+	usage := model.Usage{PromptTokens: estimatedPrompt, CompletionTokens: estimatedCompletion}
+	if u.inputTokens > 0 {
+		usage.PromptTokens = u.inputTokens
+	}
+	if u.outputTokens > 0 {
+		usage.CompletionTokens = u.outputTokens
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	return usage
+}
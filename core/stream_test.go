@@ -0,0 +1,80 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLeadingTrimmer(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"leading newlines", []string{"\n\nHello"}, "Hello"},
+		{"newlines split across chunks", []string{"\n", "\n", "Hello"}, "Hello"},
+		{"whitespace chunk before text", []string{" \r\n", "Hi\n\nthere"}, "Hi\n\nthere"},
+		{"later newlines kept", []string{"Hello", "\n\nworld"}, "Hello\n\nworld"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trimmer := &leadingTrimmer{}
+			var out strings.Builder
+			for _, chunk := range tt.chunks {
+				out.WriteString(trimmer.Trim(chunk))
+			}
+			if out.String() != tt.want {
+				t.Errorf("output = %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleResponseTrimsLeadingNewlines(t *testing.T) {
+	w, err := handle(t, &Client{}, true, textDelta("\n\n"), textDelta("\n\nHello"), textDelta(" there"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := streamChunks(t, w.Body.String())
+	if got := streamText(chunks); got != "Hello there" {
+		t.Errorf("streamed %q, want %q", got, "Hello there")
+	}
+	if first := chunks[0].Choices[0].Delta.Content; first != "Hello" {
+		t.Errorf("first chunk = %q, want %q", first, "Hello")
+	}
+}
+
+func TestTokenLimiter(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxTokens   int
+		chunks      []string
+		want        string
+		wantLimited bool
+	}{
+		{"unlimited", 0, []string{"Hello", " world"}, "Hello world", false},
+		{"under limit", 10, []string{"Hello", " world"}, "Hello world", false},
+		{"cut inside a chunk", 2, []string{"Hello", " world"}, "Hello wo", true},
+		{"exactly the budget", 2, []string{"Hell", "o wo"}, "Hello wo", false},
+		{"more text after the budget is used", 2, []string{"Hello wo", "r"}, "Hello wo", true},
+		{"cut at multibyte text", 1, []string{"你好世界朋友"}, "你好世界", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := newTokenLimiter(tt.maxTokens)
+			var out strings.Builder
+			limited := false
+			for _, chunk := range tt.chunks {
+				text, hit := limiter.Limit(chunk)
+				out.WriteString(text)
+				if hit {
+					limited = true
+					break
+				}
+			}
+			if out.String() != tt.want || limited != tt.wantLimited {
+				t.Errorf("output = %q, limited = %v, want %q, %v", out.String(), limited, tt.want, tt.wantLimited)
+			}
+		})
+	}
+}
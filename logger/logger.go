@@ -2,6 +2,7 @@ package logger
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"time"
 
@@ -36,6 +37,14 @@ var levelColors = map[int]func(format string, a ...interface{}) string{
 // 全局日志级别，默认为INFO
 var logLevel = INFO
 
+// 日志输出位置，默认为标准输出
+var output io.Writer = os.Stdout
+
+// SetOutput 设置日志输出位置
+func SetOutput(w io.Writer) {
+	output = w
+}
+
 // SetLevel 设置日志级别
 func SetLevel(level int) {
 	if level >= DEBUG && level <= FATAL {
@@ -61,7 +70,11 @@ func log(level int, format string, args ...interface{}) {
 	if level < logLevel {
 		return
 	}
+	write(level, format, args...)
+}
 
+// 输出日志，不检查日志级别
+func write(level int, format string, args ...interface{}) {
 	now := time.Now().Format("2006-01-02 15:04:05.000")
 	levelName := levelNames[level]
 	colorFunc := levelColors[level]
@@ -70,7 +83,7 @@ func log(level int, format string, args ...interface{}) {
 	logPrefix := fmt.Sprintf("[%s] [%s] ", now, levelName)
 
 	// 使用颜色输出日志级别
-	fmt.Fprintf(os.Stdout, "%s%s\n", logPrefix, colorFunc(logContent))
+	fmt.Fprintf(output, "%s%s\n", logPrefix, colorFunc(logContent))
 
 	// 如果是致命错误，则退出程序
 	if level == FATAL {
@@ -83,6 +96,15 @@ func Debug(format string, args ...interface{}) {
 	log(DEBUG, format, args...)
 }
 
+// DebugIf 打印调试日志，force 为 true 时忽略全局日志级别，用于只调试单个请求
+func DebugIf(force bool, format string, args ...interface{}) {
+	if force {
+		write(DEBUG, format, args...)
+		return
+	}
+	log(DEBUG, format, args...)
+}
+
 // Info 打印信息日志
 func Info(format string, args ...interface{}) {
 	log(INFO, format, args...)
@@ -0,0 +1,133 @@
+package model
+
+import (
+	"claude2api/logger"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// AnthropicStream 以 Anthropic 原生 SSE 格式输出流式响应
+// 事件顺序为 message_start、content_block_start/delta/stop、message_delta、message_stop
+type AnthropicStream struct {
+	gc          *gin.Context
+	inputTokens int
+	started     bool
+	index       int
+	block       string // 当前打开的内容块类型，为空表示没有打开的内容块
+}
+
+// NewAnthropicStream 创建 Anthropic 格式的流式输出，inputTokens 用于 message_start 中的 usage
+func NewAnthropicStream(gc *gin.Context, inputTokens int) *AnthropicStream {
+	return &AnthropicStream{gc: gc, inputTokens: inputTokens, index: -1}
+}
+
+// Text 输出文本增量
+func (s *AnthropicStream) Text(text string) error {
+	s.openBlock("text")
+	return s.event("content_block_delta", gin.H{
+		"type":  "content_block_delta",
+		"index": s.index,
+		"delta": gin.H{"type": "text_delta", "text": text},
+	})
+}
+
+// Reasoning 输出思考过程增量
+func (s *AnthropicStream) Reasoning(text string) error {
+	s.openBlock("thinking")
+	return s.event("content_block_delta", gin.H{
+		"type":  "content_block_delta",
+		"index": s.index,
+		"delta": gin.H{"type": "thinking_delta", "thinking": text},
+	})
+}
+
+// Error 输出 error 事件
+func (s *AnthropicStream) Error(message string) error {
+	return s.event("error", gin.H{
+		"type":  "error",
+		"error": gin.H{"type": "api_error", "message": message},
+	})
+}
+
+// Finish 关闭内容块并输出 message_delta 和 message_stop，finishReason 为 OpenAI 格式的结束原因
+func (s *AnthropicStream) Finish(finishReason string, usage Usage) error {
+	s.start()
+	s.closeBlock()
+	stopReason := "end_turn"
+	switch finishReason {
+	case "length":
+		stopReason = "max_tokens"
+	case "content_filter":
+		stopReason = "refusal"
+	}
+	if err := s.event("message_delta", gin.H{
+		"type":  "message_delta",
+		"delta": gin.H{"stop_reason": stopReason, "stop_sequence": nil},
+		"usage": gin.H{"output_tokens": usage.CompletionTokens},
+	}); err != nil {
+		return err
+	}
+	return s.event("message_stop", gin.H{"type": "message_stop"})
+}
+
+func (s *AnthropicStream) start() {
+	if s.started {
+		return
+	}
+	s.started = true
+	s.event("message_start", gin.H{
+		"type": "message_start",
+		"message": gin.H{
+			"id":            "msg_" + uuid.New().String(),
+			"type":          "message",
+			"role":          "assistant",
+			"model":         "claude-3-7-sonnet-20250219",
+			"content":       []interface{}{},
+			"stop_reason":   nil,
+			"stop_sequence": nil,
+			"usage":         gin.H{"input_tokens": s.inputTokens, "output_tokens": 0},
+		},
+	})
+}
+
+// openBlock 在内容块类型变化时关闭当前内容块并打开新的内容块
+func (s *AnthropicStream) openBlock(blockType string) {
+	s.start()
+	if s.block == blockType {
+		return
+	}
+	s.closeBlock()
+	s.index++
+	s.block = blockType
+	contentBlock := gin.H{"type": "text", "text": ""}
+	if blockType == "thinking" {
+		contentBlock = gin.H{"type": "thinking", "thinking": ""}
+	}
+	s.event("content_block_start", gin.H{
+		"type":          "content_block_start",
+		"index":         s.index,
+		"content_block": contentBlock,
+	})
+}
+
+func (s *AnthropicStream) closeBlock() {
+	if s.block == "" {
+		return
+	}
+	s.event("content_block_stop", gin.H{"type": "content_block_stop", "index": s.index})
+	s.block = ""
+}
+
+func (s *AnthropicStream) event(name string, data interface{}) error {
+	jsonBytes, err := json.Marshal(data)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error marshalling JSON: %v", err))
+		return err
+	}
+	s.gc.Writer.Write([]byte("event: " + name + "\ndata: " + string(jsonBytes) + "\n\n"))
+	s.gc.Writer.Flush()
+	return nil
+}
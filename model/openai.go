@@ -11,10 +11,21 @@ import (
 )
 
 type ChatCompletionRequest struct {
-	Model    string                   `json:"model"`
-	Messages []map[string]interface{} `json:"messages"`
-	Stream   bool                     `json:"stream"`
-	Tools    []map[string]interface{} `json:"tools,omitempty"`
+	Model               string                   `json:"model"`
+	Messages            []map[string]interface{} `json:"messages"`
+	Stream              bool                     `json:"stream"`
+	Tools               []map[string]interface{} `json:"tools,omitempty"`
+	Stop                interface{}              `json:"stop,omitempty"`
+	Language            string                   `json:"language,omitempty"`
+	NoTrim              bool                     `json:"no_trim,omitempty"`
+	SkipGlobalSystem    bool                     `json:"skip_global_system,omitempty"`
+	MaxTokens           int                      `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int                      `json:"max_completion_tokens,omitempty"`
+	N                   int                      `json:"n,omitempty"`
+	Instructions        string                   `json:"instructions,omitempty"`
+	Metadata            map[string]interface{}   `json:"metadata,omitempty"`
+	MaxImages           int                      `json:"max_images,omitempty"`
+	MaxImageBytes       int                      `json:"max_image_bytes,omitempty"`
 }
 
 // OpenAISrteamResponse 定义 OpenAI 的流式响应结构
@@ -24,6 +35,7 @@ type OpenAISrteamResponse struct {
 	Created int64          `json:"created"`
 	Model   string         `json:"model"`
 	Choices []StreamChoice `json:"choices"`
+	Usage   *Usage         `json:"usage,omitempty"`
 }
 
 // Choice 结构表示 OpenAI 返回的单个选项
@@ -43,13 +55,15 @@ type NoStreamChoice struct {
 
 // Delta 结构用于存储返回的文本内容
 type Delta struct {
-	Content string `json:"content"`
+	Content          string `json:"content,omitempty"`
+	ReasoningContent string `json:"reasoning_content,omitempty"` // 思考过程，STREAM_REASONING 开启时使用
 }
 type Message struct {
-	Role       string        `json:"role"`
-	Content    string        `json:"content"`
-	Refusal    interface{}   `json:"refusal"`
-	Annotation []interface{} `json:"annotation"`
+	Role             string        `json:"role"`
+	Content          string        `json:"content"`
+	ReasoningContent string        `json:"reasoning_content,omitempty"`
+	Refusal          interface{}   `json:"refusal"`
+	Annotation       []interface{} `json:"annotation"`
 }
 
 type OpenAIResponse struct {
@@ -74,7 +88,30 @@ func ReturnOpenAIResponse(text string, stream bool, gc *gin.Context) error {
 	}
 }
 
+// ReturnOpenAIReasoning 在流式响应中通过 reasoning_content 字段返回思考过程
+func ReturnOpenAIReasoning(text string, gc *gin.Context) error {
+	return streamDelta(Delta{ReasoningContent: text}, gc)
+}
+
+// ReturnOpenAICompletion 返回包含思考过程、结束原因和 token 用量的非流式响应
+func ReturnOpenAICompletion(text string, reasoning string, finishReason string, usage Usage, gc *gin.Context) error {
+	return noStreamCompletion(text, reasoning, finishReason, usage, gc)
+}
+
+// ReturnOpenAIFinish 在流式响应的最后发送带有 finish_reason 和 token 用量的空 chunk
+func ReturnOpenAIFinish(finishReason string, usage Usage, gc *gin.Context) error {
+	return streamChunk(Delta{}, finishReason, &usage, gc)
+}
+
 func streamRespose(text string, gc *gin.Context) error {
+	return streamDelta(Delta{Content: text}, gc)
+}
+
+func streamDelta(delta Delta, gc *gin.Context) error {
+	return streamChunk(delta, nil, nil, gc)
+}
+
+func streamChunk(delta Delta, finishReason interface{}, usage *Usage, gc *gin.Context) error {
 	openAIResp := &OpenAISrteamResponse{
 		ID:      uuid.New().String(),
 		Object:  "chat.completion.chunk",
@@ -82,14 +119,13 @@ func streamRespose(text string, gc *gin.Context) error {
 		Model:   "claude-3-7-sonnet-20250219",
 		Choices: []StreamChoice{
 			{
-				Index: 0,
-				Delta: Delta{
-					Content: text,
-				},
+				Index:        0,
+				Delta:        delta,
 				Logprobs:     nil,
-				FinishReason: nil,
+				FinishReason: finishReason,
 			},
 		},
+		Usage: usage,
 	}
 
 	jsonBytes, err := json.Marshal(openAIResp)
@@ -107,6 +143,10 @@ func streamRespose(text string, gc *gin.Context) error {
 }
 
 func noStreamResponse(text string, gc *gin.Context) error {
+	return noStreamCompletion(text, "", "stop", Usage{}, gc)
+}
+
+func noStreamCompletion(text string, reasoning string, finishReason string, usage Usage, gc *gin.Context) error {
 	openAIResp := &OpenAIResponse{
 		ID:      uuid.New().String(),
 		Object:  "chat.completion",
@@ -116,13 +156,15 @@ func noStreamResponse(text string, gc *gin.Context) error {
 			{
 				Index: 0,
 				Message: Message{
-					Role:    "assistant",
-					Content: text,
+					Role:             "assistant",
+					Content:          text,
+					ReasoningContent: reasoning,
 				},
 				Logprobs:     nil,
-				FinishReason: "stop",
+				FinishReason: finishReason,
 			},
 		},
+		Usage: usage,
 	}
 
 	gc.JSON(200, openAIResp)
@@ -6,18 +6,23 @@ import (
 	"claude2api/logger"
 	"claude2api/model"
 	"claude2api/utils"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 )
 
 type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
+// ErrUnsupportedN 每个请求只会返回一个回复，不支持 n > 1
+var ErrUnsupportedN = errors.New("n > 1 is not supported, only one completion is returned per request")
+
 // HealthCheckHandler handles the health check endpoint
 func HealthCheckHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
@@ -42,24 +47,26 @@ func ChatCompletionsHandler(c *gin.Context) {
 		return
 	}
 
-	// Process messages into prompt and extract images
-	processor := utils.NewChatRequestProcessor()
-	processor.ProcessMessages(req.Messages)
-
 	// Get model or use default
 	model := getModelOrDefault(req.Model)
+
+	processor, ok := buildProcessor(c, req, model)
+	if !ok {
+		return
+	}
+
 	index := config.Sr.NextIndex()
 	// Attempt with retry mechanism
 	for i := 0; i < config.ConfigInstance.RetryCount; i++ {
 		index = (index + 1) % len(config.ConfigInstance.Sessions)
 		session, err := config.ConfigInstance.GetSessionForModel(index)
 		if err != nil {
-			logger.Error(fmt.Sprintf("Failed to get session for model %s: %v", model, err))
+			logger.Error(withMetadata(c, fmt.Sprintf("Failed to get session for model %s: %v", model, err)))
 			logger.Info("Retrying another session")
 			continue
 		}
 
-		logger.Info(fmt.Sprintf("Using session for model %s: %s", model, session.SessionKey))
+		logger.Info(withMetadata(c, fmt.Sprintf("Using session for model %s: %s", model, session.SessionKey)))
 		if i > 0 {
 			processor.Prompt.Reset()
 			processor.Prompt.WriteString(processor.RootPrompt.String())
@@ -73,7 +80,7 @@ func ChatCompletionsHandler(c *gin.Context) {
 		logger.Info("Retrying another session")
 	}
 
-	logger.Error("Failed for all retries")
+	logger.Error(withMetadata(c, "Failed for all retries"))
 	c.JSON(http.StatusInternalServerError, ErrorResponse{
 		Error: "Failed to process request after multiple attempts"})
 }
@@ -105,13 +112,14 @@ func MirrorChatHandler(c *gin.Context) {
 		return
 	}
 
-	// Process messages into prompt and extract images
-	processor := utils.NewChatRequestProcessor()
-	processor.ProcessMessages(req.Messages)
-
 	// Get model or use default
 	model := getModelOrDefault(req.Model)
 
+	processor, ok := buildProcessor(c, req, model)
+	if !ok {
+		return
+	}
+
 	// Extract session info from auth header
 	session, err := extractSessionFromAuthHeader(c)
 	if err != nil {
@@ -139,21 +147,101 @@ func parseAndValidateRequest(c *gin.Context) (*model.ChatCompletionRequest, erro
 		Stream: defaultStream,
 	}
 
-	if err := c.ShouldBindJSON(&req); err != nil {
+	// 请求体需要读取两次：一次绑定到结构体，一次按原始格式转换消息
+	// 错误由调用方统一返回给客户端
+	var raw map[string]interface{}
+	if err := c.ShouldBindBodyWith(&raw, binding.JSON); err != nil {
+		return nil, err
+	}
+	if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+		return nil, err
+	}
+
+	// 统一 messages、input 和 prompt 等不同的请求格式
+	messages, err := utils.NormalizeRequest(raw)
+	if err != nil {
+		return nil, err
+	}
+	req.Messages = messages
+
+	// 网关可以通过 X-Claude-Model 请求头指定模型，优先于请求体中的 model
+	if headerModel := strings.TrimSpace(c.GetHeader("X-Claude-Model")); headerModel != "" {
+		logger.Info(fmt.Sprintf("Model overridden by X-Claude-Model header: %s -> %s", req.Model, headerModel))
+		req.Model = headerModel
+	}
+
+	// metadata 只用于日志记录，不会发送给 Claude
+	if len(req.Metadata) > 0 {
+		c.Set("metadata", req.Metadata)
+		logger.Info(fmt.Sprintf("Request metadata: %v", req.Metadata))
+	}
+
+	if req.N > 1 {
+		return nil, ErrUnsupportedN
+	}
+
+	return &req, nil
+}
+
+// buildProcessor 按请求参数创建并校验 ChatRequestProcessor，生成最终发送的提示词
+// 出错时直接向客户端返回错误，调用方只需检查 ok
+func buildProcessor(c *gin.Context, req *model.ChatCompletionRequest, model string) (*utils.ChatRequestProcessor, bool) {
+	maxTokens, err := utils.ResolveMaxTokens(model, req.MaxTokens, req.MaxCompletionTokens)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, ErrorResponse{
 			Error: fmt.Sprintf("Invalid request: %v", err),
 		})
-		return nil, err
+		return nil, false
+	}
+	maxImages, maxImageBytes, err := utils.ResolveImageLimits(req.MaxImages, req.MaxImageBytes)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: fmt.Sprintf("Invalid request: %v", err),
+		})
+		return nil, false
 	}
 
-	if len(req.Messages) == 0 {
+	// Process messages into prompt and extract images
+	processor := utils.NewChatRequestProcessor()
+	processor.StopSequences = utils.StopSequences(req.Stop)
+	processor.Language = req.Language
+	processor.NoTrim = req.NoTrim
+	processor.SkipGlobalSystem = req.SkipGlobalSystem
+	processor.MaxTokens = maxTokens
+	processor.MaxImages = maxImages
+	processor.MaxImageBytes = maxImageBytes
+	processor.Instructions = req.Instructions
+	// X-Debug 请求头只对本次请求开启调试日志
+	processor.Debug = c.GetHeader("X-Debug") == "true"
+	if err := processor.ProcessMessages(req.Messages); err != nil {
 		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Error: "No messages provided",
+			Error: fmt.Sprintf("Invalid request: %v", err),
 		})
-		return nil, fmt.Errorf("no messages provided")
+		return nil, false
 	}
+	if err := processor.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: fmt.Sprintf("Invalid request: %v", err),
+		})
+		return nil, false
+	}
+	if err := processor.CheckBigContextSize(); err != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, ErrorResponse{
+			Error: fmt.Sprintf("Invalid request: %v", err),
+		})
+		return nil, false
+	}
+	// 只记录最终发送的提示词
+	utils.TeePrompt(processor.RootPrompt.String())
+	return processor, true
+}
 
-	return &req, nil
+// withMetadata 在日志后附加请求的 metadata，便于按 user id、trace id 等关联同一请求的日志
+func withMetadata(c *gin.Context, message string) string {
+	if metadata, ok := c.Get("metadata"); ok {
+		return fmt.Sprintf("%s (metadata: %v)", message, metadata)
+	}
+	return message
 }
 
 func getModelOrDefault(model string) string {
@@ -187,7 +275,7 @@ func handleChatRequest(c *gin.Context, session config.SessionInfo, model string,
 	if session.OrgID == "" {
 		orgId, err := claudeClient.GetOrgID()
 		if err != nil {
-			logger.Error(fmt.Sprintf("Failed to get org ID: %v", err))
+			logger.Error(withMetadata(c, fmt.Sprintf("Failed to get org ID: %v", err)))
 			return false
 		}
 		session.OrgID = orgId
@@ -195,43 +283,69 @@ func handleChatRequest(c *gin.Context, session config.SessionInfo, model string,
 	}
 
 	claudeClient.SetOrgID(session.OrgID)
+	claudeClient.SetStopSequences(processor.StopSequences)
+	claudeClient.SetMaxTokens(processor.MaxTokens)
+	claudeClient.SetPromptTokens(processor.EstimateTokens())
+	claudeClient.SetStreamReasoning(config.ConfigInstance.StreamReasoning)
+	claudeClient.SetStreamFormat(config.ConfigInstance.StreamFormat)
 
 	// Upload images if any
 	if len(processor.ImgDataList) > 0 {
 		err := claudeClient.UploadFile(processor.ImgDataList)
 		if err != nil {
-			logger.Error(fmt.Sprintf("Failed to upload file: %v", err))
+			logger.Error(withMetadata(c, fmt.Sprintf("Failed to upload file: %v", err)))
 			return false
 		}
 	}
 
 	// Handle large context if needed
-	if processor.Prompt.Len() > config.ConfigInstance.MaxChatHistoryLength {
-		claudeClient.SetBigContext(processor.Prompt.String())
+	bigContext := processor.ShouldUseBigContext()
+	if bigContext {
+		claudeClient.SetBigContext(processor.BigContextDocuments())
 		processor.ResetForBigContext()
-		logger.Info(fmt.Sprintf("Prompt length exceeds max limit (%d), using file context", config.ConfigInstance.MaxChatHistoryLength))
+		logger.Info(fmt.Sprintf("Prompt length (%d) or image size exceeds max limit (%d), using file context", processor.RootPrompt.Len(), config.ConfigInstance.MaxChatHistoryLength))
 	}
 
-	// Create conversation
-	conversationID, err := claudeClient.CreateConversation(model)
-	if err != nil {
-		logger.Error(fmt.Sprintf("Failed to create conversation: %v", err))
-		return false
+	// 调试用：在响应头中返回本次请求实际生效的配置
+	if config.ConfigInstance.EchoEffectiveConfig {
+		c.Header("X-Effective-Config", processor.EffectiveConfigHeader(model, bigContext))
 	}
 
-	// Send message
-	if _, err := claudeClient.SendMessage(conversationID, processor.Prompt.String(), stream, c); err != nil {
-		logger.Error(fmt.Sprintf("Failed to send message: %v", err))
-		go cleanupConversation(claudeClient, conversationID, 3)
-		return false
+	// Claude 返回空回复时使用新的会话重试，最后一次的空回复照常返回给客户端
+	retries := 0
+	if config.ConfigInstance.RetryOnEmptyResponse {
+		retries = config.ConfigInstance.EmptyResponseRetries
 	}
+	for attempt := 0; ; attempt++ {
+		claudeClient.SetFailOnEmpty(attempt < retries)
 
-	// Clean up conversation if enabled
-	if config.ConfigInstance.ChatDelete {
-		go cleanupConversation(claudeClient, conversationID, 3)
-	}
+		// Create conversation
+		conversationID, err := claudeClient.CreateConversation(model, processor.DeriveTitle(config.ConfigInstance.ConversationTitleMaxLen))
+		if err != nil {
+			logger.Error(withMetadata(c, fmt.Sprintf("Failed to create conversation: %v", err)))
+			return false
+		}
+
+		// Send message
+		_, err = claudeClient.SendMessage(conversationID, processor.Prompt.String(), stream, c)
+		if errors.Is(err, core.ErrEmptyResponse) {
+			logger.Warn(withMetadata(c, fmt.Sprintf("Claude returned an empty response, retrying (%d/%d)", attempt+1, retries)))
+			go cleanupConversation(claudeClient, conversationID, 3)
+			continue
+		}
+		if err != nil {
+			logger.Error(withMetadata(c, fmt.Sprintf("Failed to send message: %v", err)))
+			go cleanupConversation(claudeClient, conversationID, 3)
+			return false
+		}
+
+		// Clean up conversation if enabled
+		if config.ConfigInstance.ChatDelete {
+			go cleanupConversation(claudeClient, conversationID, 3)
+		}
 
-	return true
+		return true
+	}
 }
 
 func cleanupConversation(client *core.Client, conversationID string, retry int) {
@@ -0,0 +1,226 @@
+package service
+
+import (
+	"bytes"
+	"claude2api/logger"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// errorBody 解析错误响应，确认响应体中只有一个 JSON 对象
+func errorBody(t *testing.T, w *httptest.ResponseRecorder) ErrorResponse {
+	t.Helper()
+	decoder := json.NewDecoder(w.Body)
+	var resp ErrorResponse
+	if err := decoder.Decode(&resp); err != nil {
+		t.Fatalf("invalid error response: %v", err)
+	}
+	if decoder.More() {
+		t.Fatalf("response has more than one body: %q", w.Body.String())
+	}
+	return resp
+}
+
+// newRequestContext 构造带有请求体和请求头的 gin 上下文
+func newRequestContext(body string, headers map[string]string) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		c.Request.Header.Set(key, value)
+	}
+	return c, w
+}
+
+func TestParseAndValidateRequestN(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr error
+	}{
+		{"n omitted", `{"messages": [{"role": "user", "content": "Hi"}]}`, nil},
+		{"n = 1", `{"n": 1, "messages": [{"role": "user", "content": "Hi"}]}`, nil},
+		{"n = 2", `{"n": 2, "messages": [{"role": "user", "content": "Hi"}]}`, ErrUnsupportedN},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, w := newRequestContext(tt.body, nil)
+			_, err := parseAndValidateRequest(c)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseAndValidateRequest() error = %v, want %v", err, tt.wantErr)
+			}
+			if w.Body.Len() != 0 {
+				t.Errorf("parseAndValidateRequest() wrote %q, want the caller to respond", w.Body.String())
+			}
+			if tt.wantErr == nil {
+				return
+			}
+			c, w = newRequestContext(tt.body, nil)
+			ChatCompletionsHandler(c)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+			}
+			if got, want := errorBody(t, w).Error, "Invalid request: "+tt.wantErr.Error(); got != want {
+				t.Errorf("error = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestParseAndValidateRequestMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    map[string]interface{}
+		wantLog string
+	}{
+		{"metadata stored and logged", `{"metadata": {"user_id": "u-1", "trace_id": "t-9"}, "messages": [{"role": "user", "content": "Hi"}]}`,
+			map[string]interface{}{"user_id": "u-1", "trace_id": "t-9"}, "Request metadata: map[trace_id:t-9 user_id:u-1]"},
+		{"no metadata", `{"messages": [{"role": "user", "content": "Hi"}]}`, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			logger.SetOutput(&logs)
+			defer logger.SetOutput(os.Stdout)
+			c, _ := newRequestContext(tt.body, nil)
+			if _, err := parseAndValidateRequest(c); err != nil {
+				t.Fatal(err)
+			}
+			got, exists := c.Get("metadata")
+			if tt.want == nil {
+				if exists {
+					t.Errorf("metadata = %v, want none", got)
+				}
+				if got := withMetadata(c, "Failed to send message"); got != "Failed to send message" {
+					t.Errorf("withMetadata() = %q, want the message unchanged", got)
+				}
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("metadata = %v, want %v", got, tt.want)
+			}
+			if !strings.Contains(logs.String(), tt.wantLog) {
+				t.Errorf("logs = %q, want %q", logs.String(), tt.wantLog)
+			}
+			// 之后的会话、发送和失败日志也带有 metadata
+			if got, want := withMetadata(c, "Failed to send message"), "Failed to send message (metadata: map[trace_id:t-9 user_id:u-1])"; got != want {
+				t.Errorf("withMetadata() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestParseAndValidateRequestModelHeader(t *testing.T) {
+	body := `{"model": "claude-3-7-sonnet-20250219", "messages": [{"role": "user", "content": "Hi"}]}`
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{"body model", nil, "claude-3-7-sonnet-20250219"},
+		{"header overrides body", map[string]string{"X-Claude-Model": "claude-sonnet-4-20250514"}, "claude-sonnet-4-20250514"},
+		{"blank header ignored", map[string]string{"X-Claude-Model": "  "}, "claude-3-7-sonnet-20250219"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newRequestContext(body, tt.headers)
+			req, err := parseAndValidateRequest(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.Model != tt.want {
+				t.Errorf("model = %q, want %q", req.Model, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildProcessor(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantErr    string
+	}{
+		{"valid request", `{"max_tokens": 100, "messages": [{"role": "user", "content": "Hi"}]}`, http.StatusOK, ""},
+		{"invalid max_tokens", `{"max_tokens": -1, "messages": [{"role": "user", "content": "Hi"}]}`, http.StatusBadRequest, "Invalid request: max_tokens must be positive, got -1"},
+		{"invalid max_images", `{"max_images": -1, "messages": [{"role": "user", "content": "Hi"}]}`, http.StatusBadRequest, "Invalid request: max_images must be between 0 and"},
+		{"only a blank user message", `{"messages": [{"role": "system", "content": "Be brief."}, {"role": "user", "content": "  "}]}`, http.StatusBadRequest, "Invalid request: no user message to answer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, w := newRequestContext(tt.body, nil)
+			req, err := parseAndValidateRequest(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			processor, ok := buildProcessor(c, req, getModelOrDefault(req.Model))
+			if ok != (tt.wantErr == "") {
+				t.Fatalf("buildProcessor() ok = %v, want %v", ok, tt.wantErr == "")
+			}
+			if ok {
+				if processor.MaxTokens != 100 {
+					t.Errorf("MaxTokens = %d, want 100", processor.MaxTokens)
+				}
+				if !strings.Contains(processor.RootPrompt.String(), "Hi") {
+					t.Errorf("root prompt = %q, want the user message", processor.RootPrompt.String())
+				}
+				if w.Body.Len() != 0 {
+					t.Errorf("buildProcessor() wrote %q on success", w.Body.String())
+				}
+				return
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := errorBody(t, w).Error; !strings.HasPrefix(got, tt.wantErr) {
+				t.Errorf("error = %q, want prefix %q", got, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseAndValidateRequestErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{"invalid json", `{"messages": [`, "Invalid request: "},
+		{"no messages", `{}`, "Invalid request: no messages provided"},
+		{"invalid input", `{"input": 5}`, "Invalid request: input must be a string or an array"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, w := newRequestContext(tt.body, nil)
+			if _, err := parseAndValidateRequest(c); err == nil {
+				t.Fatal("parseAndValidateRequest() error = nil, want an error")
+			}
+			if w.Body.Len() != 0 {
+				t.Errorf("parseAndValidateRequest() wrote %q, want the caller to respond", w.Body.String())
+			}
+			c, w = newRequestContext(tt.body, nil)
+			ChatCompletionsHandler(c)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+			}
+			if got := errorBody(t, w).Error; !strings.HasPrefix(got, tt.wantErr) {
+				t.Errorf("error = %q, want prefix %q", got, tt.wantErr)
+			}
+		})
+	}
+}
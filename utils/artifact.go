@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"claude2api/logger"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	artifactOpenTag  = "<antArtifact"
+	artifactCloseTag = "</antArtifact>"
+)
+
+// 自闭合、开始和结束的 artifact 标签
+var artifactTagRegex = regexp.MustCompile(`<antArtifact\b[^>]*/>|<antArtifact\b[^>]*>|</antArtifact\s*>`)
+
+// CleanArtifactTags 修复历史 assistant 消息中不完整的 <antArtifact> 标签
+// 被截断的回复可能留下未闭合的标签、多余的结束标签或写了一半的标签，这些会干扰 Claude 对历史的理解
+func (p *ChatRequestProcessor) CleanArtifactTags() {
+	cleaned := p.rewriteAssistantText(cleanArtifactTags)
+	if cleaned > 0 {
+		logger.Info(fmt.Sprintf("Cleaned artifact tags in %d assistant messages", cleaned))
+	}
+}
+
+// cleanArtifactTags 平衡文本中的 artifact 标签，完整的 artifact 保持不变
+// 自闭合标签和没有对应开始标签的结束标签被删除，未闭合的 artifact 补上结束标签，末尾写了一半的标签被删除
+func cleanArtifactTags(text string) string {
+	text = trimPartialArtifactTag(text)
+	if !strings.Contains(text, "antArtifact") {
+		return text
+	}
+
+	var sb strings.Builder
+	open := false
+	last := 0
+	for _, loc := range artifactTagRegex.FindAllStringIndex(text, -1) {
+		tag := text[loc[0]:loc[1]]
+		sb.WriteString(text[last:loc[0]])
+		last = loc[1]
+		switch {
+		case strings.HasSuffix(tag, "/>"):
+			// 自闭合的 artifact 没有内容，直接删除
+		case strings.HasPrefix(tag, "</"):
+			if open {
+				sb.WriteString(tag)
+				open = false
+			}
+		default:
+			if open {
+				// 上一个 artifact 没有闭合
+				sb.WriteString(artifactCloseTag + "\n")
+			}
+			sb.WriteString(tag)
+			open = true
+		}
+	}
+	sb.WriteString(text[last:])
+	if open {
+		sb.WriteString("\n" + artifactCloseTag)
+	}
+	return sb.String()
+}
+
+// trimPartialArtifactTag 删除文本末尾被截断、没有写完的 artifact 标签
+func trimPartialArtifactTag(text string) string {
+	start := strings.LastIndex(text, "<")
+	if start < 0 || strings.Contains(text[start:], ">") {
+		return text
+	}
+	partial := strings.TrimPrefix(text[start:], "<")
+	name := strings.TrimPrefix(artifactOpenTag, "<")
+	if strings.HasPrefix(partial, "/") {
+		partial = partial[1:]
+	}
+	// 至少写到 <antA 才认为是 artifact 标签，避免误删以 <a 结尾的普通文本
+	if len(partial) < len("antA") || !(strings.HasPrefix(name, partial) || strings.HasPrefix(partial, name)) {
+		return text
+	}
+	return strings.TrimRight(text[:start], " \t\r\n")
+}
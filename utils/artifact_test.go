@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"claude2api/config"
+	"testing"
+)
+
+func TestCleanArtifactTags(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"no artifacts", "Hello <b>world</b>", "Hello <b>world</b>"},
+		{"balanced artifact unchanged", `<antArtifact identifier="a">code</antArtifact> done`, `<antArtifact identifier="a">code</antArtifact> done`},
+		{"unclosed artifact", `Here: <antArtifact identifier="a">code`, "Here: <antArtifact identifier=\"a\">code\n</antArtifact>"},
+		{"stray closing tag", "Done.</antArtifact> Bye", "Done. Bye"},
+		{"self-closing tag removed", `See <antArtifact identifier="a"/> here`, "See  here"},
+		{"second artifact opens before first closes", `<antArtifact id="a">one<antArtifact id="b">two</antArtifact>`, "<antArtifact id=\"a\">one</antArtifact>\n<antArtifact id=\"b\">two</antArtifact>"},
+		{"partial opening tag at the end", "Here it is: <antArti", "Here it is:"},
+		{"partial attributes at the end", `Here: <antArtifact identifier="a`, "Here:"},
+		{"partial closing tag at the end", `<antArtifact id="a">code</antArt`, "<antArtifact id=\"a\">code\n</antArtifact>"},
+		{"short tag prefix kept", "Compare x <a", "Compare x <a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cleanArtifactTags(tt.text); got != tt.want {
+				t.Errorf("cleanArtifactTags() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCleanArtifactTagsInHistory(t *testing.T) {
+	setConfig(t, &config.ConfigInstance.CleanArtifactTags, true)
+	p := NewChatRequestProcessor()
+	msgs := messages("user", "Write <antArtifact", "assistant", `<antArtifact id="a">code`, "user", "Thanks")
+	if err := p.ProcessMessages(msgs); err != nil {
+		t.Fatal(err)
+	}
+	want := "Human: Write <antArtifact\n\nAssistant: <antArtifact id=\"a\">code\n</antArtifact>\n\nHuman: Thanks\n\n"
+	if got := p.Prompt.String(); got != want {
+		t.Errorf("prompt = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"claude2api/config"
+	"claude2api/logger"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxBigContextBytes Claude 单个文件附件的大小上限
+const MaxBigContextBytes = 30 << 20
+
+// CheckBigContextSize 在 BigContextOverflowPolicy 为 error 时检查大型上下文文件是否超过 MaxBigContextBytes
+func (p *ChatRequestProcessor) CheckBigContextSize() error {
+	if config.ConfigInstance.BigContextOverflowPolicy != "error" || p.Prompt.Len() <= MaxBigContextBytes {
+		return nil
+	}
+	if !p.ShouldUseBigContext() {
+		return nil
+	}
+	return fmt.Errorf("context of %d bytes exceeds the Claude file size limit (%d bytes)", p.Prompt.Len(), MaxBigContextBytes)
+}
+
+// BigContextDocuments 返回作为大型上下文上传的文件内容
+// 超过 MaxBigContextBytes 时按 BigContextOverflowPolicy 保留开头和结尾（truncate）或拆分为多个文件（split）
+func (p *ChatRequestProcessor) BigContextDocuments() []string {
+	context := p.Prompt.String()
+	p.bigContextParts = 1
+	if len(context) <= MaxBigContextBytes {
+		return []string{context}
+	}
+
+	switch config.ConfigInstance.BigContextOverflowPolicy {
+	case "truncate":
+		logger.Warn(fmt.Sprintf("Big context of %d bytes exceeds file size limit, truncating the middle", len(context)))
+		return []string{truncateMiddle(context, MaxBigContextBytes)}
+	case "split":
+		documents := splitDocument(context, MaxBigContextBytes)
+		p.bigContextParts = len(documents)
+		logger.Info(fmt.Sprintf("Big context of %d bytes exceeds file size limit, splitting into %d files", len(context), len(documents)))
+		return documents
+	}
+	return []string{context}
+}
+
+// BigContextFileName 返回第 index 个大型上下文文件的文件名，第一个文件为 context.txt
+func BigContextFileName(index int) string {
+	if index == 0 {
+		return "context.txt"
+	}
+	return fmt.Sprintf("context_%d.txt", index+1)
+}
+
+// truncateMiddle 保留文本开头和结尾各一半，中间替换为省略说明，结果不超过 limit 字节
+func truncateMiddle(text string, limit int) string {
+	marker := func(omitted int) string {
+		return fmt.Sprintf("\n\n[... %d bytes omitted ...]\n\n", omitted)
+	}
+	budget := limit - len(marker(len(text)))
+	head := runeBoundary(text, budget/2)
+	tail := len(text) - (budget - head)
+	for tail < len(text) && !utf8.RuneStart(text[tail]) {
+		tail++
+	}
+	return text[:head] + marker(tail-head) + text[tail:]
+}
+
+// splitDocument 按行把文本拆分为不超过 limit 字节的多段，单行超过 limit 时在字符边界拆分
+func splitDocument(text string, limit int) []string {
+	var parts []string
+	for len(text) > limit {
+		end := runeBoundary(text, limit)
+		if newline := strings.LastIndexByte(text[:end], '\n'); newline >= end/2 {
+			end = newline + 1
+		}
+		parts = append(parts, text[:end])
+		text = text[end:]
+	}
+	return append(parts, text)
+}
+
+// runeBoundary 返回不超过 n 的最大字符边界
+func runeBoundary(text string, n int) int {
+	if n >= len(text) {
+		return len(text)
+	}
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+	return n
+}
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"claude2api/config"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateMiddle(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		want  string
+	}{
+		{"ascii", strings.Repeat("a", 50) + strings.Repeat("b", 50), 60, strings.Repeat("a", 14) + "\n\n[... 71 bytes omitted ...]\n\n" + strings.Repeat("b", 15)},
+		{"multibyte runes", strings.Repeat("你", 20) + strings.Repeat("好", 20), 60, strings.Repeat("你", 4) + "\n\n[... 93 bytes omitted ...]\n\n" + strings.Repeat("好", 5)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateMiddle(tt.text, tt.limit)
+			if got != tt.want {
+				t.Errorf("truncateMiddle() = %q, want %q", got, tt.want)
+			}
+			if len(got) > tt.limit || !utf8.ValidString(got) {
+				t.Errorf("truncateMiddle() returned %d bytes (valid %v), limit %d", len(got), utf8.ValidString(got), tt.limit)
+			}
+		})
+	}
+}
+
+func TestSplitDocument(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		want  []string
+	}{
+		{"fits", "line one\nline two\n", 100, []string{"line one\nline two\n"}},
+		{"split at newline", "aaaa\nbbbb\ncccc\n", 12, []string{"aaaa\nbbbb\n", "cccc\n"}},
+		{"long line split at the limit", strings.Repeat("x", 25), 10, []string{strings.Repeat("x", 10), strings.Repeat("x", 10), strings.Repeat("x", 5)}},
+		{"newline too early is ignored", "a\n" + strings.Repeat("x", 18), 10, []string{"a\n" + strings.Repeat("x", 8), strings.Repeat("x", 10)}},
+		{"multibyte long line", strings.Repeat("你", 5), 7, []string{"你你", "你你", "你"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitDocument(tt.text, tt.limit)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitDocument() = %q, want %q", got, tt.want)
+			}
+			if strings.Join(got, "") != tt.text {
+				t.Errorf("parts do not add up to the original text")
+			}
+		})
+	}
+}
+
+func TestBigContextFileName(t *testing.T) {
+	for index, want := range []string{"context.txt", "context_2.txt", "context_3.txt"} {
+		if got := BigContextFileName(index); got != want {
+			t.Errorf("BigContextFileName(%d) = %q, want %q", index, got, want)
+		}
+	}
+}
+
+func TestBigContextOverflowPolicy(t *testing.T) {
+	setConfig(t, &config.ConfigInstance.MaxChatHistoryLength, 1000)
+	oversized := strings.Repeat(strings.Repeat("x", 1023)+"\n", MaxBigContextBytes/1024+10)
+	tests := []struct {
+		name      string
+		policy    string
+		prompt    string
+		wantErr   bool
+		wantParts int
+	}{
+		{"small context", "error", "Hello", false, 1},
+		{"error rejects", "error", oversized, true, 0},
+		{"truncate", "truncate", oversized, false, 1},
+		{"split", "split", oversized, false, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.ConfigInstance.BigContextOverflowPolicy, tt.policy)
+			p := NewChatRequestProcessor()
+			p.Prompt.WriteString(tt.prompt)
+			if err := p.CheckBigContextSize(); (err != nil) != tt.wantErr {
+				t.Fatalf("CheckBigContextSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			documents := p.BigContextDocuments()
+			if len(documents) != tt.wantParts {
+				t.Fatalf("got %d documents, want %d", len(documents), tt.wantParts)
+			}
+			for i, document := range documents {
+				if len(document) > MaxBigContextBytes {
+					t.Errorf("document %d has %d bytes, exceeds %d", i, len(document), MaxBigContextBytes)
+				}
+			}
+
+			p.ResetForBigContext()
+			note := "context.txt is split into 2 files, read them in order: context.txt, context_2.txt"
+			if got := strings.Contains(p.Prompt.String(), note); got != (tt.wantParts > 1) {
+				t.Errorf("prompt %q mentions split files = %v, want %v", p.Prompt.String(), got, tt.wantParts > 1)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"bytes"
+	"claude2api/logger"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// decompressDataURI 解压 gzip/deflate 压缩的图片 data URI，返回普通的 base64 data URI
+// 压缩方式由 data URI 参数（如 data:image/png;gzip;base64,...）标记，或根据解码后数据的文件头识别
+// 未压缩的图片原样返回，声明了压缩方式但解压失败时返回 false
+// 只根据文件头识别出的压缩方式解压失败时按未压缩处理，原样返回
+func decompressDataURI(img string) (string, bool) {
+	meta, payload, ok := strings.Cut(strings.TrimPrefix(img, "data:"), ",")
+	if !ok {
+		return img, true
+	}
+	params := strings.Split(meta, ";")
+	mimeType, encoding := params[0], ""
+	isBase64 := false
+	for _, param := range params[1:] {
+		switch strings.ToLower(strings.TrimSpace(param)) {
+		case "base64":
+			isBase64 = true
+		case "gzip", "content-encoding=gzip":
+			encoding = "gzip"
+		case "deflate", "content-encoding=deflate":
+			encoding = "deflate"
+		}
+	}
+	if !isBase64 {
+		return img, true
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		// 交给 filterImage 按 InvalidImagePolicy 处理
+		return img, true
+	}
+	declared := encoding != ""
+	if !declared {
+		encoding = compressionOf(data)
+	}
+	if encoding == "" {
+		return img, true
+	}
+
+	decompressed, err := decompress(data, encoding)
+	if err != nil && !declared {
+		logger.Debug(fmt.Sprintf("Image data looks like %s but does not decompress, using it as is: %v", encoding, err))
+		return img, true
+	}
+	if err != nil {
+		logger.Warn(fmt.Sprintf("Skipping image, failed to decompress %s data: %v", encoding, err))
+		return "", false
+	}
+	logger.Info(fmt.Sprintf("Decompressed %s image: %d -> %d bytes", encoding, len(data), len(decompressed)))
+	return "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(decompressed), true
+}
+
+// compressionOf 根据文件头识别 gzip 和 zlib 格式的数据
+func compressionOf(data []byte) string {
+	if len(data) < 2 {
+		return ""
+	}
+	if data[0] == 0x1f && data[1] == 0x8b {
+		return "gzip"
+	}
+	// zlib 头: CM 为 8（deflate），且前两个字节组成的数是 31 的倍数
+	if data[0]&0x0f == 8 && (uint16(data[0])<<8|uint16(data[1]))%31 == 0 {
+		return "deflate"
+	}
+	return ""
+}
+
+// decompress 解压数据，deflate 先按 zlib 格式解析，失败时按原始 deflate 解析
+// 解压后的大小不超过单张图片的绝对上限，避免压缩炸弹
+func decompress(data []byte, encoding string) ([]byte, error) {
+	var reader io.ReadCloser
+	var err error
+	if encoding == "gzip" {
+		reader, err = gzip.NewReader(bytes.NewReader(data))
+	} else if reader, err = zlib.NewReader(bytes.NewReader(data)); err != nil {
+		reader, err = flate.NewReader(bytes.NewReader(data)), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	decompressed, err := io.ReadAll(io.LimitReader(reader, maxImageBytesCeiling+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > maxImageBytesCeiling {
+		return nil, fmt.Errorf("decompressed image exceeds %d bytes", maxImageBytesCeiling)
+	}
+	return decompressed, nil
+}
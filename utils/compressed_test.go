@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"bytes"
+	"claude2api/config"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestDecompressDataURI(t *testing.T) {
+	setConfig(t, &config.ConfigInstance.AcceptCompressedImages, true)
+	setConfig(t, &config.ConfigInstance.AllowedImageMimeTypes, []string{"image/png"})
+
+	var raw bytes.Buffer
+	if err := png.Encode(&raw, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write(raw.Bytes())
+	gw.Close()
+	var deflated bytes.Buffer
+	zw := zlib.NewWriter(&deflated)
+	zw.Write(raw.Bytes())
+	zw.Close()
+
+	encode := func(params string, data []byte) string {
+		return "data:image/png" + params + ";base64," + base64.StdEncoding.EncodeToString(data)
+	}
+	plain := encode("", raw.Bytes())
+	// 前两个字节恰好像 zlib 头的未压缩数据
+	zlibLike := encode("", []byte{0x78, 0x9c, 'n', 'o', 't', ' ', 'z', 'l', 'i', 'b'})
+
+	tests := []struct {
+		name   string
+		img    string
+		want   string
+		wantOk bool
+	}{
+		{"gzip declared", encode(";gzip", gzipped.Bytes()), plain, true},
+		{"gzip sniffed", encode("", gzipped.Bytes()), plain, true},
+		{"deflate declared", encode(";deflate", deflated.Bytes()), plain, true},
+		{"uncompressed", plain, plain, true},
+		{"declared but corrupt", encode(";gzip", []byte("not gzip")), "", false},
+		{"sniffed but uncompressed", zlibLike, zlibLike, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := filterImage(tt.img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.wantOk || got != tt.want {
+				t.Errorf("filterImage() = %.40q, %v, want %.40q, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
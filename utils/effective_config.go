@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"claude2api/config"
+	"encoding/json"
+)
+
+// EffectiveConfig 返回本次请求实际生效的配置（已应用请求级别的覆盖），用于调试
+// 不包含 session、API Key、代理地址等敏感信息
+func (p *ChatRequestProcessor) EffectiveConfig(model string, bigContext bool) map[string]interface{} {
+	cfg := config.ConfigInstance
+	return map[string]interface{}{
+		"model":                    model,
+		"big_context":              bigContext,
+		"language":                 p.responseLanguage(),
+		"no_trim":                  p.NoTrim,
+		"skip_global_system":       p.SkipGlobalSystem,
+		"max_tokens":               p.MaxTokens,
+		"stop":                     p.StopSequences,
+		"images":                   len(p.ImgDataList),
+		"max_context_messages":     cfg.MaxContextMessages,
+		"hard_max_messages":        cfg.HardMaxMessages,
+		"max_system_tokens":        cfg.MaxSystemTokens,
+		"no_role_prefix":           cfg.NoRolePrefix,
+		"prompt_disable_artifacts": cfg.PromptDisableArtifacts,
+		"image_position_in_turn":   cfg.ImagePositionInTurn,
+		"keep_latest_image_only":   cfg.KeepLatestImageOnly,
+		"stream_reasoning":         cfg.StreamReasoning,
+		"request_validations":      cfg.RequestValidations,
+		"sessions":                 len(cfg.Sessions),
+	}
+}
+
+// EffectiveConfigHeader 把 EffectiveConfig 编码为单行 JSON，用作响应头
+func (p *ChatRequestProcessor) EffectiveConfigHeader(model string, bigContext bool) string {
+	data, err := json.Marshal(p.EffectiveConfig(model, bigContext))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"claude2api/config"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestEffectiveConfig(t *testing.T) {
+	setConfig(t, &config.ConfigInstance.Sessions, []config.SessionInfo{{SessionKey: "sk-secret"}})
+	tests := []struct {
+		name     string
+		override func(p *ChatRequestProcessor)
+		key      string
+		want     interface{}
+	}{
+		{"default no_trim", func(p *ChatRequestProcessor) {}, "no_trim", false},
+		{"no_trim override", func(p *ChatRequestProcessor) { p.NoTrim = true }, "no_trim", true},
+		{"max_tokens override", func(p *ChatRequestProcessor) { p.MaxTokens = 256 }, "max_tokens", float64(256)},
+		{"language override", func(p *ChatRequestProcessor) { p.Language = "French" }, "language", "French"},
+		{"session count only", func(p *ChatRequestProcessor) {}, "sessions", float64(1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewChatRequestProcessor()
+			tt.override(p)
+			header := p.EffectiveConfigHeader("claude-sonnet-4", true)
+			if strings.Contains(header, "sk-secret") {
+				t.Fatalf("header leaks the session key: %s", header)
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal([]byte(header), &got); err != nil {
+				t.Fatalf("invalid header %q: %v", header, err)
+			}
+			if got["model"] != "claude-sonnet-4" || got["big_context"] != true {
+				t.Errorf("model = %v, big_context = %v", got["model"], got["big_context"])
+			}
+			if got[tt.key] != tt.want {
+				t.Errorf("%s = %v, want %v", tt.key, got[tt.key], tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"claude2api/config"
+	"encoding/json"
+	"strings"
+)
+
+// ParseEncodedContent 解析被客户端编码为 JSON 字符串的内容块数组，如 "[{\"type\":\"text\",...}]"
+// 最多解码 MaxEncodedContentDepth 次，达到上限仍未得到内容块时保留原始字符串
+func ParseEncodedContent(content interface{}) interface{} {
+	text, ok := content.(string)
+	if !ok {
+		return content
+	}
+
+	var value interface{} = text
+	for depth := 0; depth < config.ConfigInstance.MaxEncodedContentDepth; depth++ {
+		encoded, ok := value.(string)
+		trimmed := strings.TrimSpace(encoded)
+		if !ok || trimmed == "" || !strings.ContainsRune(`[{"`, rune(trimmed[0])) {
+			return content
+		}
+		if err := json.Unmarshal([]byte(trimmed), &value); err != nil {
+			return content
+		}
+		switch v := value.(type) {
+		case []interface{}, map[string]interface{}:
+			if strings.TrimSpace(contentText(v)) != "" || contentHasImage(v) {
+				return v
+			}
+			return content
+		}
+	}
+	return content
+}
+
+// decodeEncodedContent 在宽松解析模式下解码消息中被编码为 JSON 字符串的内容
+func (p *ChatRequestProcessor) decodeEncodedContent() {
+	messages := make([]map[string]interface{}, 0, len(p.Messages))
+	for _, msg := range p.Messages {
+		decoded := ParseEncodedContent(msg["content"])
+		if _, isString := decoded.(string); isString || decoded == nil {
+			messages = append(messages, msg)
+			continue
+		}
+		copied := make(map[string]interface{}, len(msg))
+		for key, value := range msg {
+			copied[key] = value
+		}
+		copied["content"] = decoded
+		messages = append(messages, copied)
+	}
+	p.Messages = messages
+}
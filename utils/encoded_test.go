@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"claude2api/config"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// encode 把 value 编码为 JSON 字符串 times 次
+func encode(t *testing.T, value interface{}, times int) string {
+	t.Helper()
+	for i := 0; i < times; i++ {
+		data, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value = string(data)
+	}
+	return value.(string)
+}
+
+func TestParseEncodedContent(t *testing.T) {
+	items := []interface{}{textItem("Hello")}
+	tests := []struct {
+		name    string
+		depth   int
+		content interface{}
+		want    interface{}
+	}{
+		{"plain text", 3, "Hello", "Hello"},
+		{"encoded once", 3, encode(t, items, 1), items},
+		{"triple-encoded", 3, encode(t, items, 3), items},
+		{"triple-encoded over depth limit", 2, encode(t, items, 3), encode(t, items, 3)},
+		{"decoding disabled", 0, encode(t, items, 1), encode(t, items, 1)},
+		{"encoded plain string", 3, encode(t, "Hello", 1), encode(t, "Hello", 1)},
+		{"invalid json", 3, `[{"type": "text"`, `[{"type": "text"`},
+		{"encoded items without text", 3, encode(t, []interface{}{textItem(" ")}, 1), encode(t, []interface{}{textItem(" ")}, 1)},
+		{"already items", 3, items, items},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.ConfigInstance.MaxEncodedContentDepth, tt.depth)
+			if got := ParseEncodedContent(tt.content); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseEncodedContent() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeEncodedContentInPrompt(t *testing.T) {
+	setConfig(t, &config.ConfigInstance.MaxEncodedContentDepth, 3)
+	content := encode(t, []interface{}{textItem("Hello")}, 3)
+	tests := []struct {
+		name    string
+		lenient bool
+		want    string
+	}{
+		{"strict keeps the string", false, "Human: " + content + "\n\n"},
+		{"lenient decodes", true, "Human: Hello\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.ConfigInstance.LenientContentParsing, tt.lenient)
+			p := NewChatRequestProcessor()
+			if err := p.ProcessMessages(messages("user", content)); err != nil {
+				t.Fatal(err)
+			}
+			if got := p.Prompt.String(); got != tt.want {
+				t.Errorf("prompt = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
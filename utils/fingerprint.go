@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+)
+
+// ContentFingerprint 计算消息语义内容的哈希，用于缓存和去重
+// 只包含角色、文本、图片摘要和 tool_calls 的函数，不包含时间戳、请求 ID、metadata 和 tool_call id 等易变字段
+func (p *ChatRequestProcessor) ContentFingerprint() string {
+	h := sha256.New()
+	for _, msg := range p.Messages {
+		role, _ := msg["role"].(string)
+		writeFingerprintField(h, "role", role)
+		writeFingerprintField(h, "text", contentText(msg["content"]))
+		for _, url := range imageURLs(msg["content"]) {
+			digest := sha256.Sum256([]byte(url))
+			writeFingerprintField(h, "image", hex.EncodeToString(digest[:]))
+		}
+		if toolCalls, ok := msg["tool_calls"].([]interface{}); ok {
+			for _, call := range toolCalls {
+				callMap, _ := call.(map[string]interface{})
+				function, _ := json.Marshal(callMap["function"])
+				writeFingerprintField(h, "tool_call", string(function))
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeFingerprintField 写入带长度前缀的字段，避免不同字段拼接后产生相同的输入
+func writeFingerprintField(h hash.Hash, name string, value string) {
+	fmt.Fprintf(h, "%s:%d:%s\n", name, len(value), value)
+}
+
+// imageURLs 返回消息内容中的图片地址
+func imageURLs(content interface{}) []string {
+	var urls []string
+	switch v := content.(type) {
+	case []interface{}:
+		for _, item := range v {
+			urls = append(urls, imageURLs(item)...)
+		}
+	case map[string]interface{}:
+		if !contentHasImage(v) {
+			break
+		}
+		if imageUrl, ok := v["image_url"].(map[string]interface{}); ok {
+			if url, ok := imageUrl["url"].(string); ok {
+				urls = append(urls, url)
+			}
+		}
+	}
+	return urls
+}
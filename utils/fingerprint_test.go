@@ -0,0 +1,52 @@
+package utils
+
+import "testing"
+
+// fingerprintMessages 构造用于计算指纹的消息，build 可以修改其中的字段
+func fingerprintMessages(build func(msgs []map[string]interface{})) []map[string]interface{} {
+	msgs := []map[string]interface{}{
+		{"role": "user", "content": []interface{}{textItem("Weather?"), imageItem("https://example.com/a.png")}, "timestamp": 1700000000},
+		{"role": "assistant", "tool_calls": []interface{}{map[string]interface{}{"id": "call_1", "function": map[string]interface{}{"name": "weather"}}}},
+		{"role": "tool", "tool_call_id": "call_1", "content": "Sunny"},
+	}
+	if build != nil {
+		build(msgs)
+	}
+	return msgs
+}
+
+func TestContentFingerprint(t *testing.T) {
+	tests := []struct {
+		name     string
+		build    func(msgs []map[string]interface{})
+		wantSame bool
+	}{
+		{"identical", nil, true},
+		{"different timestamp", func(msgs []map[string]interface{}) { msgs[0]["timestamp"] = 1800000000 }, true},
+		{"metadata added", func(msgs []map[string]interface{}) { msgs[0]["metadata"] = map[string]interface{}{"trace_id": "t-1"} }, true},
+		{"different tool_call id", func(msgs []map[string]interface{}) {
+			msgs[1]["tool_calls"] = []interface{}{map[string]interface{}{"id": "call_2", "function": map[string]interface{}{"name": "weather"}}}
+			msgs[2]["tool_call_id"] = "call_2"
+		}, true},
+		{"different text", func(msgs []map[string]interface{}) { msgs[2]["content"] = "Rainy" }, false},
+		{"different role", func(msgs []map[string]interface{}) { msgs[2]["role"] = "user" }, false},
+		{"different image", func(msgs []map[string]interface{}) {
+			msgs[0]["content"] = []interface{}{textItem("Weather?"), imageItem("https://example.com/b.png")}
+		}, false},
+		{"different function", func(msgs []map[string]interface{}) {
+			msgs[1]["tool_calls"] = []interface{}{map[string]interface{}{"id": "call_1", "function": map[string]interface{}{"name": "forecast"}}}
+		}, false},
+	}
+	base := NewChatRequestProcessor()
+	base.Messages = fingerprintMessages(nil)
+	want := base.ContentFingerprint()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewChatRequestProcessor()
+			p.Messages = fingerprintMessages(tt.build)
+			if got := p.ContentFingerprint(); (got == want) != tt.wantSame {
+				t.Errorf("fingerprint same = %v, want %v", got == want, tt.wantSame)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"bytes"
+	"claude2api/logger"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/fatih/color"
+)
+
+// setConfig 在测试期间修改一项配置，测试结束后恢复原值
+func setConfig[T any](t *testing.T, field *T, value T) {
+	t.Helper()
+	old := *field
+	*field = value
+	t.Cleanup(func() { *field = old })
+}
+
+// messages 用交替的 role 和 content 构造消息列表
+func messages(pairs ...string) []map[string]interface{} {
+	var msgs []map[string]interface{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		msgs = append(msgs, map[string]interface{}{"role": pairs[i], "content": pairs[i+1]})
+	}
+	return msgs
+}
+
+// textItem 构造文本内容块
+func textItem(text string) map[string]interface{} {
+	return map[string]interface{}{"type": "text", "text": text}
+}
+
+// imageItem 构造图片内容块
+func imageItem(url string) map[string]interface{} {
+	return map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": url}}
+}
+
+// logBuffer 可以被多个 goroutine 同时写入的日志缓冲区
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs 在测试期间把日志写入缓冲区
+func captureLogs(t *testing.T) *logBuffer {
+	t.Helper()
+	buf := &logBuffer{}
+	logger.SetOutput(buf)
+	setConfig(t, &color.NoColor, true)
+	t.Cleanup(func() { logger.SetOutput(os.Stdout) })
+	return buf
+}
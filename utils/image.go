@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"bytes"
+	"claude2api/config"
+	"claude2api/logger"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// ImagePlaceholder 只有图片没有文字的用户消息使用的占位文本
+const ImagePlaceholder = "[Image]"
+
+// 无法读取尺寸时每张图片的估算 token 数，也是单张图片的上限（Claude 会缩小更大的图片）
+const defaultImageTokens = 1600
+
+// ParseDataURI 解析 data:image/png;base64,... 格式的图片，返回 MIME 类型和解码后的数据
+func ParseDataURI(dataURI string) (string, []byte, error) {
+	parts := strings.SplitN(dataURI, ",", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "data:") {
+		return "", nil, errors.New("invalid data URI format")
+	}
+	meta := strings.TrimPrefix(parts[0], "data:")
+	mimeType, encoding, ok := strings.Cut(meta, ";")
+	if !ok || encoding != "base64" {
+		return "", nil, errors.New("invalid encoding in data URI")
+	}
+	data, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, err
+	}
+	return mimeType, data, nil
+}
+
+// EstimateImageTokens 根据图片尺寸估算 token 数（宽 * 高 / 750），远程 URL 或无法解码时使用固定估算值
+func EstimateImageTokens(img string) int {
+	_, data, err := ParseDataURI(img)
+	if err != nil {
+		return defaultImageTokens
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width <= 0 || cfg.Height <= 0 {
+		return defaultImageTokens
+	}
+
+	tokens := cfg.Width * cfg.Height / 750
+	if tokens > defaultImageTokens {
+		return defaultImageTokens
+	}
+	if tokens < 1 {
+		return 1
+	}
+	return tokens
+}
+
+// imageMimeType 优先根据图片内容检测 MIME 类型，无法识别时使用 data URI 中声明的类型
+func imageMimeType(declared string, data []byte) string {
+	if detected := http.DetectContentType(data); strings.HasPrefix(detected, "image/") {
+		return detected
+	}
+	return declared
+}
+
+// ImageConverter 把不支持的图片转换为支持的格式（如 BMP/TIFF 转 PNG），返回转换后的数据和 MIME 类型
+// 默认不做转换，转换后仍不在 AllowedImageMimeTypes 中的图片会被丢弃
+var ImageConverter = func(data []byte, fromMime string) ([]byte, string, error) {
+	return data, fromMime, nil
+}
+
+// 请求级别的图片限制不能超过的上限
+const (
+	maxImagesCeiling     = 20
+	maxImageBytesCeiling = 30 << 20
+)
+
+// ResolveImageLimits 返回本次请求生效的图片数量和单张图片字节数限制
+// 请求未指定时使用 MaxImagesPerRequest 和 MaxImageBytes，指定的值不能超过绝对上限，0 表示不限制
+func ResolveImageLimits(maxImages int, maxImageBytes int) (int, int, error) {
+	if maxImages < 0 || maxImages > maxImagesCeiling {
+		return 0, 0, fmt.Errorf("max_images must be between 0 and %d (0 = default), got %d", maxImagesCeiling, maxImages)
+	}
+	if maxImageBytes < 0 || maxImageBytes > maxImageBytesCeiling {
+		return 0, 0, fmt.Errorf("max_image_bytes must be between 0 and %d (0 = default), got %d", maxImageBytesCeiling, maxImageBytes)
+	}
+	if maxImages == 0 {
+		maxImages = config.ConfigInstance.MaxImagesPerRequest
+	}
+	if maxImageBytes == 0 {
+		maxImageBytes = config.ConfigInstance.MaxImageBytes
+	}
+	return maxImages, maxImageBytes, nil
+}
+
+// addImage 校验图片并加入图片列表，返回图片是否被保留
+// 超过 MaxImages 或 MaxImageBytes 的图片会被丢弃
+func (p *ChatRequestProcessor) addImage(img string) (bool, error) {
+	if p.MaxImages > 0 && len(p.ImgDataList) >= p.MaxImages {
+		logger.Warn(fmt.Sprintf("Dropping image, request already has %d images", p.MaxImages))
+		return false, nil
+	}
+	filtered, ok, err := filterImage(img)
+	if err != nil || !ok {
+		return false, err
+	}
+	if p.MaxImageBytes > 0 {
+		if _, data, err := ParseDataURI(filtered); err == nil && len(data) > p.MaxImageBytes {
+			logger.Warn(fmt.Sprintf("Dropping image of %d bytes, exceeds max image bytes (%d)", len(data), p.MaxImageBytes))
+			return false, nil
+		}
+	}
+	p.ImgDataList = append(p.ImgDataList, filtered)
+	return true, nil
+}
+
+// filterImage 丢弃 MIME 类型不在 AllowedImageMimeTypes 中的图片，远程 URL 无法检测时保留
+// 不支持的图片会先交给 ImageConverter 尝试转换
+// 无法解码的 data URI 按 InvalidImagePolicy 跳过或返回错误
+// 开启 AcceptCompressedImages 时先解压 gzip/deflate 压缩的图片
+func filterImage(img string) (string, bool, error) {
+	if !strings.HasPrefix(img, "data:") {
+		return img, true, nil
+	}
+	if config.ConfigInstance.AcceptCompressedImages {
+		decompressed, ok := decompressDataURI(img)
+		if !ok {
+			return "", false, nil
+		}
+		img = decompressed
+	}
+	declared, data, err := ParseDataURI(img)
+	if err != nil {
+		if config.ConfigInstance.InvalidImagePolicy == "error" {
+			return "", false, fmt.Errorf("invalid image data: %w", err)
+		}
+		logger.Warn(fmt.Sprintf("Skipping invalid image data: %v", err))
+		return "", false, nil
+	}
+
+	allowed := config.ConfigInstance.AllowedImageMimeTypes
+	mimeType := imageMimeType(declared, data)
+	if slices.Contains(allowed, mimeType) {
+		return img, true, nil
+	}
+
+	converted, convertedMime, err := ImageConverter(data, mimeType)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("Dropping image, failed to convert %s: %v", mimeType, err))
+		return "", false, nil
+	}
+	if !slices.Contains(allowed, convertedMime) {
+		logger.Warn(fmt.Sprintf("Dropping image with unsupported MIME type: %s", mimeType))
+		return "", false, nil
+	}
+	logger.Info(fmt.Sprintf("Converted image from %s to %s", mimeType, convertedMime))
+	return "data:" + convertedMime + ";base64," + base64.StdEncoding.EncodeToString(converted), true, nil
+}
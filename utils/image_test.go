@@ -0,0 +1,216 @@
+package utils
+
+import (
+	"bytes"
+	"claude2api/config"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func pngDataURI(t *testing.T, width, height int) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestResolveImageLimits(t *testing.T) {
+	setConfig(t, &config.ConfigInstance.MaxImagesPerRequest, 5)
+	setConfig(t, &config.ConfigInstance.MaxImageBytes, 1000)
+
+	tests := []struct {
+		name                  string
+		images, bytes         int
+		wantImages, wantBytes int
+		wantErr               bool
+	}{
+		{"defaults", 0, 0, 5, 1000, false},
+		{"overrides", 2, 500, 2, 500, false},
+		{"at ceiling", maxImagesCeiling, maxImageBytesCeiling, maxImagesCeiling, maxImageBytesCeiling, false},
+		{"too many images", maxImagesCeiling + 1, 0, 0, 0, true},
+		{"negative bytes", 0, -1, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			images, imageBytes, err := ResolveImageLimits(tt.images, tt.bytes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveImageLimits() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if images != tt.wantImages || imageBytes != tt.wantBytes {
+				t.Errorf("ResolveImageLimits() = %d, %d, want %d, %d", images, imageBytes, tt.wantImages, tt.wantBytes)
+			}
+		})
+	}
+}
+
+func TestAddImageLimits(t *testing.T) {
+	small := pngDataURI(t, 1, 1)
+	_, data, _ := ParseDataURI(small)
+
+	tests := []struct {
+		name          string
+		maxImages     int
+		maxImageBytes int
+		want          int
+	}{
+		{"unlimited", 0, 0, 3},
+		{"count limit", 2, 0, 2},
+		{"size limit", 0, len(data) - 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewChatRequestProcessor()
+			p.MaxImages, p.MaxImageBytes = tt.maxImages, tt.maxImageBytes
+			for i := 0; i < 3; i++ {
+				if _, err := p.addImage(small); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(p.ImgDataList) != tt.want {
+				t.Errorf("kept %d images, want %d", len(p.ImgDataList), tt.want)
+			}
+		})
+	}
+}
+
+func TestEstimateImageTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		img  string
+		want int
+	}{
+		{"known size", pngDataURI(t, 150, 100), 20},
+		{"tiny image", pngDataURI(t, 1, 1), 1},
+		{"capped", pngDataURI(t, 2000, 2000), defaultImageTokens},
+		{"remote url", "https://example.com/a.png", defaultImageTokens},
+		{"undecodable", "data:image/png;base64,bm90IGFuIGltYWdl", defaultImageTokens},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EstimateImageTokens(tt.img); got != tt.want {
+				t.Errorf("EstimateImageTokens() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	p := NewChatRequestProcessor()
+	p.Prompt.WriteString("abcdefgh")
+	p.ImgDataList = []string{pngDataURI(t, 150, 100)}
+	if got := p.EstimateTokens(); got != 22 {
+		t.Errorf("EstimateTokens() = %d, want 22", got)
+	}
+}
+
+// bmpDataURI 返回一个 1x1 的 BMP 图片
+func bmpDataURI() string {
+	header := []byte{
+		'B', 'M', 58, 0, 0, 0, 0, 0, 0, 0, 54, 0, 0, 0,
+		40, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1, 0, 24, 0, 0, 0, 0, 0, 4, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		255, 255, 255, 0,
+	}
+	return "data:image/bmp;base64," + base64.StdEncoding.EncodeToString(header)
+}
+
+func TestFilterImageMimeTypes(t *testing.T) {
+	pngImg := pngDataURI(t, 1, 1)
+	tests := []struct {
+		name    string
+		allowed []string
+		img     string
+		wantOk  bool
+	}{
+		{"allowed png", []string{"image/png"}, pngImg, true},
+		{"bmp not allowed", []string{"image/png", "image/jpeg"}, bmpDataURI(), false},
+		{"bmp allowed", []string{"image/bmp"}, bmpDataURI(), true},
+		{"png declared as jpeg is detected", []string{"image/png"}, strings.Replace(pngImg, "image/png", "image/jpeg", 1), true},
+		{"remote url kept", []string{"image/png"}, "https://example.com/a.bmp", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.ConfigInstance.AllowedImageMimeTypes, tt.allowed)
+			got, ok, err := filterImage(tt.img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.wantOk {
+				t.Errorf("filterImage() kept = %v, want %v", ok, tt.wantOk)
+			}
+			if ok && got != tt.img {
+				t.Errorf("filterImage() changed the image")
+			}
+		})
+	}
+}
+
+func TestImageConverter(t *testing.T) {
+	setConfig(t, &config.ConfigInstance.AllowedImageMimeTypes, []string{"image/png"})
+	converted := []byte("converted png")
+	tests := []struct {
+		name      string
+		converter func([]byte, string) ([]byte, string, error)
+		want      string
+		wantOk    bool
+	}{
+		{"no converter", ImageConverter, "", false},
+		{"converted to png", func(data []byte, from string) ([]byte, string, error) {
+			if from != "image/bmp" {
+				t.Errorf("converter called with %s, want image/bmp", from)
+			}
+			return converted, "image/png", nil
+		}, "data:image/png;base64," + base64.StdEncoding.EncodeToString(converted), true},
+		{"converted to another unsupported type", func(data []byte, from string) ([]byte, string, error) {
+			return data, "image/tiff", nil
+		}, "", false},
+		{"conversion fails", func(data []byte, from string) ([]byte, string, error) {
+			return nil, "", errors.New("cannot convert")
+		}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &ImageConverter, tt.converter)
+			got, ok, err := filterImage(bmpDataURI())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.wantOk || got != tt.want {
+				t.Errorf("filterImage() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestInvalidImagePolicy(t *testing.T) {
+	corrupt := "data:image/png;base64,not*base64!"
+	tests := []struct {
+		name       string
+		policy     string
+		wantErr    bool
+		wantImages int
+	}{
+		{"skip", "skip", false, 1},
+		{"error", "error", true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.ConfigInstance.InvalidImagePolicy, tt.policy)
+			p := NewChatRequestProcessor()
+			msgs := []map[string]interface{}{{"role": "user", "content": []interface{}{
+				textItem("Compare"), imageItem(corrupt), imageItem(pngDataURI(t, 1, 1)),
+			}}}
+			err := p.ProcessMessages(msgs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ProcessMessages() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && len(p.ImgDataList) != tt.wantImages {
+				t.Errorf("got %d images, want %d", len(p.ImgDataList), tt.wantImages)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"unicode"
+)
+
+// DetectLanguage 根据文字所属的书写系统粗略判断语言，无法判断时返回空字符串
+func DetectLanguage(text string) string {
+	var han, kana, hangul, cyrillic, letters int
+	for _, r := range text {
+		switch {
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			kana++
+		case unicode.Is(unicode.Han, r):
+			han++
+		case unicode.Is(unicode.Hangul, r):
+			hangul++
+		case unicode.Is(unicode.Cyrillic, r):
+			cyrillic++
+		case !unicode.IsLetter(r):
+			continue
+		}
+		letters++
+	}
+	if letters == 0 {
+		return ""
+	}
+
+	// 假名只出现在日文中，优先于汉字判断
+	switch {
+	case kana > 0 && (kana+han)*3 >= letters:
+		return "Japanese"
+	case hangul*3 >= letters && hangul > 0:
+		return "Korean"
+	case han*3 >= letters && han > 0:
+		return "Chinese"
+	case cyrillic*3 >= letters && cyrillic > 0:
+		return "Russian"
+	}
+	return ""
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"claude2api/config"
+	"strings"
+	"testing"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"你好，请帮我看看这段代码", "Chinese"},
+		{"これは日本語の文章です", "Japanese"},
+		{"안녕하세요 반갑습니다", "Korean"},
+		{"Привет, как дела?", "Russian"},
+		{"Hello, how are you?", ""},
+		{"12345 !!!", ""},
+		{"Please translate 你好", ""},
+	}
+	for _, tt := range tests {
+		if got := DetectLanguage(tt.text); got != tt.want {
+			t.Errorf("DetectLanguage(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestResponseLanguageInstruction(t *testing.T) {
+	tests := []struct {
+		name     string
+		match    bool
+		language string
+		message  string
+		want     string
+	}{
+		{"chinese message", true, "", "你好，今天天气怎么样？", "System: Respond in Chinese.\n\n"},
+		{"detection disabled", false, "", "你好，今天天气怎么样？", ""},
+		{"english message", true, "", "How is the weather?", ""},
+		{"request language wins", true, "French", "你好", "System: Respond in French.\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.ConfigInstance.MatchResponseLanguage, tt.match)
+			setConfig(t, &config.ConfigInstance.GlobalSystemPrompt, "")
+			p := NewChatRequestProcessor()
+			p.Language = tt.language
+			if err := p.ProcessMessages(messages("user", tt.message)); err != nil {
+				t.Fatal(err)
+			}
+			got := strings.TrimSuffix(p.Prompt.String(), "Human: "+tt.message+"\n\n")
+			if got != tt.want {
+				t.Errorf("prompt before the message = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNoMessages 请求中没有 messages、input 或 prompt
+var ErrNoMessages = errors.New("no messages provided")
+
+// NormalizeRequest 把不同格式的请求转换为处理器使用的 messages 数组
+// 支持 Chat Completions 和 Anthropic 的 messages（含顶层 system）、Responses API 的 input 以及旧版的 prompt 字符串
+func NormalizeRequest(raw map[string]interface{}) ([]map[string]interface{}, error) {
+	var messages []map[string]interface{}
+	if system, ok := raw["system"]; ok {
+		if text := contentText(normalizeContent(system)); strings.TrimSpace(text) != "" {
+			messages = append(messages, map[string]interface{}{"role": "system", "content": text})
+		}
+	}
+
+	switch {
+	case raw["messages"] != nil:
+		items, ok := raw["messages"].([]interface{})
+		if !ok {
+			return nil, errors.New("messages must be an array")
+		}
+		normalized, err := normalizeMessages(items)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, normalized...)
+	case raw["input"] != nil:
+		switch v := raw["input"].(type) {
+		case string:
+			messages = append(messages, map[string]interface{}{"role": "user", "content": v})
+		case []interface{}:
+			normalized, err := normalizeMessages(v)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, normalized...)
+		default:
+			return nil, errors.New("input must be a string or an array")
+		}
+	case raw["prompt"] != nil:
+		switch v := raw["prompt"].(type) {
+		case string:
+			messages = append(messages, map[string]interface{}{"role": "user", "content": v})
+		case []interface{}:
+			var prompts []string
+			for _, item := range v {
+				if text, ok := item.(string); ok {
+					prompts = append(prompts, text)
+				}
+			}
+			messages = append(messages, map[string]interface{}{"role": "user", "content": strings.Join(prompts, "\n\n")})
+		default:
+			return nil, errors.New("prompt must be a string or an array of strings")
+		}
+	}
+
+	for _, msg := range messages {
+		if role, _ := msg["role"].(string); role != "system" {
+			return messages, nil
+		}
+	}
+	return nil, ErrNoMessages
+}
+
+// normalizeMessages 复制消息并转换内容格式，Responses API 中没有 role 的项（如函数调用结果）会被跳过
+func normalizeMessages(items []interface{}) ([]map[string]interface{}, error) {
+	var messages []map[string]interface{}
+	for i, item := range items {
+		msg, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("message %d must be an object", i)
+		}
+		if _, ok := msg["role"].(string); !ok {
+			continue
+		}
+		copied := make(map[string]interface{}, len(msg))
+		for key, value := range msg {
+			copied[key] = value
+		}
+		if content, ok := msg["content"]; ok {
+			copied["content"] = normalizeContent(content)
+		}
+		messages = append(messages, copied)
+	}
+	return messages, nil
+}
+
+// normalizeContent 把 Responses API 和 Anthropic 的内容块转换为 Chat Completions 的 text 和 image_url 内容块
+func normalizeContent(content interface{}) interface{} {
+	switch v := content.(type) {
+	case []interface{}:
+		items := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			if itemMap, ok := item.(map[string]interface{}); ok {
+				items = append(items, normalizeContentItem(itemMap))
+				continue
+			}
+			items = append(items, item)
+		}
+		return items
+	case map[string]interface{}:
+		return normalizeContentItem(v)
+	}
+	return content
+}
+
+func normalizeContentItem(item map[string]interface{}) map[string]interface{} {
+	itemType, _ := item["type"].(string)
+	switch itemType {
+	case "input_text", "output_text":
+		return map[string]interface{}{"type": "text", "text": item["text"]}
+	case "input_image", "image_url":
+		// Responses API 和部分客户端直接使用字符串作为 image_url
+		if url, ok := item["image_url"].(string); ok {
+			return imageURLItem(url)
+		}
+	case "image":
+		// Anthropic 的图片格式: {"type": "image", "source": {"type": "base64", "media_type": ..., "data": ...}}
+		source, _ := item["source"].(map[string]interface{})
+		sourceType, _ := source["type"].(string)
+		switch sourceType {
+		case "base64":
+			mediaType, _ := source["media_type"].(string)
+			data, _ := source["data"].(string)
+			return imageURLItem("data:" + mediaType + ";base64," + data)
+		case "url":
+			if url, ok := source["url"].(string); ok {
+				return imageURLItem(url)
+			}
+		}
+	}
+	return item
+}
+
+func imageURLItem(url string) map[string]interface{} {
+	return map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": url}}
+}
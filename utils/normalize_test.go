@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeRequest(t *testing.T) {
+	hi := []map[string]interface{}{{"role": "user", "content": "Hi"}}
+	tests := []struct {
+		name    string
+		body    string
+		want    []map[string]interface{}
+		wantErr error
+	}{
+		{"chat messages", `{"messages": [{"role": "user", "content": "Hi"}]}`, hi, nil},
+		{"responses input string", `{"input": "Hi"}`, hi, nil},
+		{"legacy prompt string", `{"prompt": "Hi"}`, hi, nil},
+		{"legacy prompt array", `{"prompt": ["Hi", "there"]}`, []map[string]interface{}{{"role": "user", "content": "Hi\n\nthere"}}, nil},
+		{"responses input items", `{"input": [{"role": "user", "content": [{"type": "input_text", "text": "Hi"}, {"type": "input_image", "image_url": "https://example.com/a.png"}]}, {"type": "function_call_output", "output": "ignored"}]}`,
+			[]map[string]interface{}{{"role": "user", "content": []interface{}{textItem("Hi"), imageItem("https://example.com/a.png")}}}, nil},
+		{"anthropic system and image", `{"system": "Be brief.", "messages": [{"role": "user", "content": [{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "AAAA"}}]}]}`,
+			[]map[string]interface{}{{"role": "system", "content": "Be brief."}, {"role": "user", "content": []interface{}{imageItem("data:image/png;base64,AAAA")}}}, nil},
+		{"messages take precedence", `{"messages": [{"role": "user", "content": "Hi"}], "prompt": "ignored"}`, hi, nil},
+		{"nothing to answer", `{"model": "claude"}`, nil, ErrNoMessages},
+		{"only system", `{"system": "Be brief.", "messages": []}`, nil, ErrNoMessages},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var raw map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.body), &raw); err != nil {
+				t.Fatal(err)
+			}
+			got, err := NormalizeRequest(raw)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NormalizeRequest() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NormalizeRequest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeRequestInvalidShapes(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"messages not an array", `{"messages": "Hi"}`},
+		{"message not an object", `{"messages": ["Hi"]}`},
+		{"input of wrong type", `{"input": 1}`},
+		{"prompt of wrong type", `{"prompt": {"text": "Hi"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var raw map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.body), &raw); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := NormalizeRequest(raw); err == nil {
+				t.Error("NormalizeRequest() error = nil, want an error")
+			}
+		})
+	}
+}
@@ -4,17 +4,41 @@ package utils
 import (
 	"claude2api/config"
 	"claude2api/logger"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 )
 
+// ErrNoUserMessage 请求中没有可以回答的用户消息
+var ErrNoUserMessage = errors.New("no user message to answer")
+
 // ChatRequestProcessor handles common chat request processing logic
 type ChatRequestProcessor struct {
-	Prompt          strings.Builder
-	RootPrompt      strings.Builder
-	ImgDataList     []string
-	LastUserMessage string
-	Messages        []map[string]interface{}
+	Prompt           strings.Builder
+	RootPrompt       strings.Builder
+	ImgDataList      []string
+	LastUserMessage  string
+	Messages         []map[string]interface{}
+	StopSequences    []string
+	Language         string                   // 客户端指定的回复语言
+	NoTrim           bool                     // 客户端自行管理上下文，不裁剪消息
+	SkipGlobalSystem bool                     // 不添加全局system提示词
+	MaxTokens        int                      // 回复的最大 token 数，0 表示不限制
+	Instructions     string                   // Responses API 的 instructions 字段，作为首条system消息
+	Debug            bool                     // 本次请求忽略全局日志级别，输出调试日志
+	MaxImages        int                      // 最多上传的图片数量，0 表示不限制
+	MaxImageBytes    int                      // 单张图片的最大字节数，0 表示不限制
+	globalSystem     string                   // 本次请求实际使用的全局system提示词
+	skipImages       bool                     // 当前消息的图片不上传，只保留占位文本
+	inputMessages    []map[string]interface{} // 客户端传入的原始消息，用于重新生成提示词
+	truncatedUser    string                   // 截断后的最新用户消息文本，非空时替换原内容，也避免重复截断
+	bigContextParts  int                      // 大型上下文拆分后的文件数
+	// AddSystemPrompt 添加的提示词，放在所有消息之前或之后
+	startSystemPrompts []string
+	endSystemPrompts   []string
+	// FoldSystemIntoFirstUser 合并 system 内容后的用户消息内容，按消息下标索引，nil 表示未合并
+	foldedContent map[int]interface{}
 }
 
 // NewChatRequestProcessor creates a new processor instance
@@ -25,75 +49,480 @@ func NewChatRequestProcessor() *ChatRequestProcessor {
 		ImgDataList:     []string{},
 		LastUserMessage: "",
 		Messages:        []map[string]interface{}{},
+		StopSequences:   []string{},
 	}
 }
 
 // ProcessMessages processes the messages array into a prompt and extracts images
-func (p *ChatRequestProcessor) ProcessMessages(messages []map[string]interface{}) {
+func (p *ChatRequestProcessor) ProcessMessages(messages []map[string]interface{}) error {
 	// 保存完整的消息列表
+	p.inputMessages = messages
 	p.Messages = messages
+	if p.Instructions != "" {
+		p.Messages = append([]map[string]interface{}{{"role": "system", "content": p.Instructions}}, messages...)
+	}
+
+	// 宽松解析模式下解码被编码为 JSON 字符串的内容
+	if config.ConfigInstance.LenientContentParsing {
+		p.decodeEncodedContent()
+	}
+
+	// 合并相邻的system消息，避免裁剪时只保留最后一条
+	if config.ConfigInstance.MergeContiguousSystemOnly {
+		p.MergeContiguousSystemMessages()
+	}
+
+	// 去除历史回复中的思考过程
+	if config.ConfigInstance.StripThinkingFromHistory {
+		p.StripThinkingFromHistory()
+	}
+
+	// 修复历史回复中不完整的 artifact 标签
+	if config.ConfigInstance.CleanArtifactTags {
+		p.CleanArtifactTags()
+	}
+
+	if err := p.handleTrailingBlankUser(); err != nil {
+		return err
+	}
+	// 合并末尾连续的用户消息，作为同一个问题
+	if config.ConfigInstance.MergeTrailingUserMessages {
+		p.MergeTrailingUserMessages()
+	}
 
 	// 首先进行消息数量限制
 	p.TrimMessages()
+	p.applyTruncatedUser()
 
-	if config.ConfigInstance.PromptDisableArtifacts {
-		p.Prompt.WriteString("System: Forbidden to use <antArtifac> </antArtifac> to wrap code blocks, use markdown syntax instead, which means wrapping code blocks with ``` ```\n\n")
+	if !p.SkipGlobalSystem {
+		p.globalSystem = config.ConfigInstance.GlobalSystemPrompt
+	}
+	p.LimitSystemTokens()
+	// system 内容放入第一条用户消息，不单独输出 System 轮次
+	if config.ConfigInstance.FoldSystemIntoFirstUser {
+		p.FoldSystemIntoFirstUser()
 	}
 
-	for _, msg := range p.Messages {
+	p.writeSystemPreamble()
+
+	if language := p.responseLanguage(); language != "" && p.foldedContent == nil {
+		p.Prompt.WriteString(fmt.Sprintf("System: Respond in %s.\n\n", language))
+	}
+
+	latestImageTurn := p.latestImageTurn()
+	for i, msg := range p.Messages {
 		role, roleOk := msg["role"].(string)
 		if !roleOk {
 			continue // Skip invalid format
 		}
+		// 只保留最后一个带图片的用户消息中的图片
+		p.skipImages = config.ConfigInstance.KeepLatestImageOnly && i != latestImageTurn
 
 		content, exists := msg["content"]
-		if !exists {
+		if p.foldedContent != nil {
+			// system 内容已合并到用户消息中
+			if role == "system" {
+				continue
+			}
+			if folded, ok := p.foldedContent[i]; ok {
+				content, exists = folded, true
+			}
+		}
+		toolCalls, hasToolCalls := msg["tool_calls"].([]interface{})
+		if !exists && !hasToolCalls {
 			continue
 		}
 
 		rolePrefix := GetRolePrefix(role)
+		// 消息可以通过 prefix 字段覆盖本轮的角色前缀
+		if prefix, ok := msg["prefix"].(string); ok {
+			rolePrefix = prefix
+		}
 
 		p.Prompt.WriteString(rolePrefix)
+		if err := p.writeContent(role, rolePrefix, content); err != nil {
+			return err
+		}
+		// assistant 消息可以同时包含文本和 tool_calls，文本之后写入序列化的 tool_calls
+		if hasToolCalls && len(toolCalls) > 0 {
+			if toolCallsJSON, err := json.Marshal(toolCalls); err == nil {
+				p.Prompt.WriteString(string(toolCallsJSON) + "\n\n")
+			} else {
+				logger.Warn(fmt.Sprintf("Failed to serialize tool_calls: %v", err))
+			}
+		}
+		logger.DebugIf(p.Debug, fmt.Sprintf("LastUserMessage: %s", p.LastUserMessage))
+	}
+	if p.foldedContent == nil {
+		for _, text := range p.endSystemPrompts {
+			p.Prompt.WriteString("System: " + text + "\n\n")
+		}
+	}
+	p.RootPrompt.WriteString(p.Prompt.String())
+	// Debug output
+	p.logPrompt("Processed prompt", p.Prompt.String())
+	logger.DebugIf(p.Debug, fmt.Sprintf("Image data list: %v", p.ImgDataList))
+	tokens := p.EstimateTokens()
+	logger.Info(fmt.Sprintf("Estimated prompt tokens: %d (%d images)", tokens, len(p.ImgDataList)))
+	p.warnPromptTokens(tokens)
+	return p.fitLatestUserMessage()
+}
+
+// warnPromptTokens 在提示词 token 数超过 WarnPromptTokens 但未超过 MaxPromptTokens 时输出警告
+// 超过 MaxPromptTokens 的提示词由 size 检查或截断处理
+func (p *ChatRequestProcessor) warnPromptTokens(tokens int) {
+	warnTokens := config.ConfigInstance.WarnPromptTokens
+	maxTokens := config.ConfigInstance.MaxPromptTokens
+	if warnTokens <= 0 || tokens <= warnTokens || (maxTokens > 0 && tokens > maxTokens) {
+		return
+	}
+	logger.Warn(fmt.Sprintf("Prompt is approaching the context limit: %d estimated tokens (warn threshold %d)", tokens, warnTokens))
+}
+
+// latestImageTurn 返回最后一个带图片的用户消息的下标，没有时返回 -1
+func (p *ChatRequestProcessor) latestImageTurn() int {
+	for i := len(p.Messages) - 1; i >= 0; i-- {
+		if role, _ := p.Messages[i]["role"].(string); role == "user" && contentHasImage(p.Messages[i]["content"]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// handleTrailingBlankUser 处理末尾只有空白的用户消息，Claude无法回答这样的消息
+// TrailingBlankUserPolicy 为 drop 时丢弃这些消息，为 error 时返回 ErrNoUserMessage
+// 丢弃后没有剩下可以回答的用户消息时也返回 ErrNoUserMessage
+func (p *ChatRequestProcessor) handleTrailingBlankUser() error {
+	dropped := false
+	for len(p.Messages) > 0 && isBlankUserMessage(p.Messages[len(p.Messages)-1]) {
+		if config.ConfigInstance.TrailingBlankUserPolicy == "error" {
+			return ErrNoUserMessage
+		}
+		logger.Warn("Dropping trailing whitespace-only user message")
+		p.Messages = p.Messages[:len(p.Messages)-1]
+		dropped = true
+	}
+	if !dropped {
+		return nil
+	}
+	for _, msg := range p.Messages {
+		if role, _ := msg["role"].(string); role == "user" && !isBlankUserMessage(msg) {
+			return nil
+		}
+	}
+	return ErrNoUserMessage
+}
+
+// isBlankUserMessage 判断消息是否为只有空白、没有图片的用户消息
+func isBlankUserMessage(msg map[string]interface{}) bool {
+	if role, _ := msg["role"].(string); role != "user" {
+		return false
+	}
+	return strings.TrimSpace(contentText(msg["content"])) == "" && !contentHasImage(msg["content"])
+}
+
+// logPrompt 按 DebugPromptMode 输出提示词调试日志
+func (p *ChatRequestProcessor) logPrompt(label string, prompt string) {
+	switch config.ConfigInstance.DebugPromptMode {
+	case "off":
+		return
+	case "full":
+		logger.DebugIf(p.Debug, fmt.Sprintf("%s: %s", label, prompt))
+	default:
+		runes := []rune(prompt)
+		maxChars := config.ConfigInstance.DebugPromptPreviewChars
+		if maxChars < 0 || len(runes) <= maxChars {
+			logger.DebugIf(p.Debug, fmt.Sprintf("%s: %s", label, prompt))
+			return
+		}
+		logger.DebugIf(p.Debug, fmt.Sprintf("%s (preview %d/%d chars): %s...", label, maxChars, len(runes), string(runes[:maxChars])))
+	}
+}
+
+// MergeContiguousSystemMessages 合并相邻的system消息，穿插在对话中的system消息保持独立
+func (p *ChatRequestProcessor) MergeContiguousSystemMessages() {
+	var merged []map[string]interface{}
+	var pending []map[string]interface{}
+
+	// 只有一条system消息时保留原消息及其 prefix 等字段，多条时合并为新的消息
+	flush := func() {
+		switch len(pending) {
+		case 0:
+			return
+		case 1:
+			merged = append(merged, pending[0])
+		default:
+			var texts []string
+			for _, msg := range pending {
+				texts = append(texts, contentText(msg["content"]))
+			}
+			merged = append(merged, map[string]interface{}{
+				"role":    "system",
+				"content": strings.Join(texts, "\n\n"),
+			})
+		}
+		pending = nil
+	}
+
+	for _, msg := range p.Messages {
+		if role, ok := msg["role"].(string); ok && role == "system" {
+			pending = append(pending, msg)
+			continue
+		}
+		flush()
+		merged = append(merged, msg)
+	}
+	flush()
+
+	if len(merged) != len(p.Messages) {
+		logger.Info(fmt.Sprintf("Merged contiguous system messages: %d -> %d messages", len(p.Messages), len(merged)))
+	}
+	p.Messages = merged
+}
+
+// MergeTrailingUserMessages 把末尾连续的多条用户消息合并为一条
+// 文本用空行连接，图片按原顺序放在文本之后
+func (p *ChatRequestProcessor) MergeTrailingUserMessages() {
+	start := len(p.Messages)
+	for start > 0 {
+		if role, _ := p.Messages[start-1]["role"].(string); role != "user" {
+			break
+		}
+		start--
+	}
+	if len(p.Messages)-start < 2 {
+		return
+	}
+
+	var texts []string
+	var images []interface{}
+	for _, msg := range p.Messages[start:] {
+		if text := contentText(msg["content"]); strings.TrimSpace(text) != "" {
+			texts = append(texts, text)
+		}
+		var items []interface{}
+		switch v := msg["content"].(type) {
+		case []interface{}:
+			items = v
+		case map[string]interface{}:
+			items = []interface{}{v}
+		}
+		for _, item := range items {
+			if itemMap, ok := item.(map[string]interface{}); ok && contentHasImage(itemMap) {
+				images = append(images, itemMap)
+			}
+		}
+	}
+
+	text := strings.Join(texts, "\n\n")
+	var content interface{} = text
+	if len(images) > 0 {
+		content = append([]interface{}{map[string]interface{}{"type": "text", "text": text}}, images...)
+	}
+	logger.Info(fmt.Sprintf("Merged %d trailing user messages", len(p.Messages)-start))
+	merged := append([]map[string]interface{}{}, p.Messages[:start]...)
+	p.Messages = append(merged, map[string]interface{}{"role": "user", "content": content})
+}
+
+// writeSystemPreamble 写入代理自身添加的system提示词，已合并到第一条用户消息时不写入
+func (p *ChatRequestProcessor) writeSystemPreamble() {
+	if p.foldedContent != nil {
+		return
+	}
+	for _, text := range p.systemPreamble() {
+		p.Prompt.WriteString("System: " + text + "\n\n")
+	}
+}
+
+// systemPreamble 返回代理自身添加的system提示词：禁用 artifacts 的提示、全局提示词和 AddSystemPrompt 添加在开头的提示词
+func (p *ChatRequestProcessor) systemPreamble() []string {
+	var texts []string
+	if config.ConfigInstance.PromptDisableArtifacts {
+		texts = append(texts, "Forbidden to use <antArtifac> </antArtifac> to wrap code blocks, use markdown syntax instead, which means wrapping code blocks with ``` ```")
+	}
+	if p.globalSystem != "" {
+		texts = append(texts, p.globalSystem)
+	}
+	return append(texts, p.startSystemPrompts...)
+}
+
+// writeContent 把消息内容写入提示词，文本写入提示词，图片加入图片列表
+// 图片在提示词中留下 [Image N] 标记，ImagePositionInTurn 决定标记位于文本之前、之后还是原位置
+func (p *ChatRequestProcessor) writeContent(role string, rolePrefix string, content interface{}) error {
+	var items []interface{}
+	switch v := content.(type) {
+	case string: // If content is directly a string
+		p.Prompt.WriteString(v + "\n\n")
+		if role == "user" {
+			p.LastUserMessage = rolePrefix + v + "\n\n"
+		}
+		return nil
+	case []interface{}: // If content is an array of []interface{} type
+		items = v
+	case map[string]interface{}: // If content is a single content block
+		items = []interface{}{v}
+	}
+
+	var texts, markers, inline []string
+	hasImage := false
+	for _, item := range items {
+		itemMap, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		// 宽松解析时同时带有 text 和 image_url 的内容块先处理文本再处理图片
+		if text, ok := itemText(itemMap); ok {
+			texts = append(texts, text)
+			inline = append(inline, text)
+		}
+		if !contentHasImage(itemMap) {
+			continue
+		}
+		hasImage = true
+		imageUrl, _ := itemMap["image_url"].(map[string]interface{})
+		url, ok := imageUrl["url"].(string)
+		if !ok {
+			continue
+		}
+		if p.skipImages {
+			markers = append(markers, ImagePlaceholder)
+			inline = append(inline, ImagePlaceholder)
+			continue
+		}
+		kept, err := p.addImage(url)
+		if err != nil {
+			return err
+		}
+		if kept {
+			marker := fmt.Sprintf("[Image %d]", len(p.ImgDataList))
+			markers = append(markers, marker)
+			inline = append(inline, marker)
+		}
+	}
+
+	hasText := false
+	for _, text := range texts {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		hasText = true
+		if role == "user" {
+			p.LastUserMessage = rolePrefix + text + "\n\n"
+		}
+	}
+	// 只有图片的消息仍然需要有效的轮次，图片全部被丢弃时使用占位符
+	// 用户消息使用图片标记作为最后的用户消息，大型上下文模式需要引用它
+	if !hasText && hasImage {
+		if len(markers) == 0 {
+			markers = []string{ImagePlaceholder}
+			inline = append(inline, ImagePlaceholder)
+		}
+		if role == "user" {
+			p.LastUserMessage = rolePrefix + strings.Join(markers, " ") + "\n\n"
+		}
+	}
+
+	var parts []string
+	switch config.ConfigInstance.ImagePositionInTurn {
+	case "before":
+		parts = append(markers, texts...)
+	case "inline":
+		parts = inline
+	default:
+		parts = append(texts, markers...)
+	}
+	for _, part := range parts {
+		p.Prompt.WriteString(part + "\n\n")
+	}
+	return nil
+}
+
+// itemText 返回文本内容块中的文本
+// 开启 LenientContentParsing 时，没有可识别文本字段的内容块会使用 value 字段
+func itemText(itemMap map[string]interface{}) (string, bool) {
+	if itemType, _ := itemMap["type"].(string); itemType == "text" {
+		if text, ok := itemMap["text"].(string); ok {
+			return text, true
+		}
+	}
+	if config.ConfigInstance.LenientContentParsing {
+		// 类型不是 text 的内容块也可能带有 text 字段，例如同时带有 image_url 的内容块
+		if text, ok := itemMap["text"].(string); ok {
+			return text, true
+		}
+		if value, ok := itemMap["value"].(string); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// responseLanguage 返回需要Claude使用的回复语言，优先使用客户端指定的语言
+func (p *ChatRequestProcessor) responseLanguage() string {
+	if p.Language != "" {
+		return p.Language
+	}
+	if !config.ConfigInstance.MatchResponseLanguage {
+		return ""
+	}
+	for i := len(p.Messages) - 1; i >= 0; i-- {
+		if role, ok := p.Messages[i]["role"].(string); ok && role == "user" {
+			return DetectLanguage(contentText(p.Messages[i]["content"]))
+		}
+	}
+	return ""
+}
 
-		switch v := content.(type) {
-		case string: // If content is directly a string
-			p.Prompt.WriteString(v + "\n\n")
-			if role == "user" {
-				p.LastUserMessage = rolePrefix + v + "\n\n"
+// contentHasImage 判断消息内容中是否包含图片
+func contentHasImage(content interface{}) bool {
+	switch v := content.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if itemMap, ok := item.(map[string]interface{}); ok && contentHasImage(itemMap) {
+				return true
 			}
-		case []interface{}: // If content is an array of []interface{} type
-			for _, item := range v {
-				if itemMap, ok := item.(map[string]interface{}); ok {
-					if itemType, ok := itemMap["type"].(string); ok {
-						if itemType == "text" {
-							if text, ok := itemMap["text"].(string); ok {
-								p.Prompt.WriteString(text + "\n\n")
-								if role == "user" {
-									p.LastUserMessage = rolePrefix + text + "\n\n"
-								}
-							}
-						} else if itemType == "image_url" {
-							if imageUrl, ok := itemMap["image_url"].(map[string]interface{}); ok {
-								if url, ok := imageUrl["url"].(string); ok {
-									p.ImgDataList = append(p.ImgDataList, url)
-								}
-							}
-						}
-					}
+		}
+	case map[string]interface{}:
+		itemType, _ := v["type"].(string)
+		if config.ConfigInstance.LenientContentParsing && v["image_url"] != nil {
+			return true
+		}
+		return itemType == "image_url"
+	}
+	return false
+}
+
+// contentText 提取消息内容中的文本部分
+func contentText(content interface{}) string {
+	switch v := content.(type) {
+	case string:
+		return v
+	case []interface{}:
+		var texts []string
+		for _, item := range v {
+			if itemMap, ok := item.(map[string]interface{}); ok {
+				if text, ok := itemText(itemMap); ok {
+					texts = append(texts, text)
 				}
 			}
 		}
-		logger.Debug(fmt.Sprintf("LastUserMessage: %s", p.LastUserMessage))
+		return strings.Join(texts, "\n\n")
+	case map[string]interface{}:
+		return contentText([]interface{}{v})
 	}
-	p.RootPrompt.WriteString(p.Prompt.String())
-	// Debug output
-	logger.Debug(fmt.Sprintf("Processed prompt: %s", p.Prompt.String()))
-	logger.Debug(fmt.Sprintf("Image data list: %v", p.ImgDataList))
+	return ""
 }
 
 // TrimMessages 限制消息数量，保留最新的system消息和最新的N条消息
 func (p *ChatRequestProcessor) TrimMessages() {
 	maxMsgs := config.ConfigInstance.MaxContextMessages
+	if p.NoTrim {
+		// 请求要求不裁剪时，只保留硬性上限
+		if config.ConfigInstance.HardMaxMessages <= 0 {
+			return
+		}
+		maxMsgs = config.ConfigInstance.HardMaxMessages
+	}
 
 	// 如果消息数量未超过限制，直接返回
 	if len(p.Messages) <= maxMsgs {
@@ -102,6 +531,13 @@ func (p *ChatRequestProcessor) TrimMessages() {
 
 	logger.Info(fmt.Sprintf("Messages count (%d) exceeds max limit (%d), trimming messages", len(p.Messages), maxMsgs))
 
+	// 只合并相邻 system 消息时穿插在对话中的 system 消息保持原位置
+	if config.ConfigInstance.MergeContiguousSystemOnly {
+		p.trimKeepingSystemInPlace(maxMsgs)
+		logger.Info(fmt.Sprintf("Messages trimmed to %d", len(p.Messages)))
+		return
+	}
+
 	// 找出最新的system消息
 	var systemMsg map[string]interface{}
 	var otherMsgs []map[string]interface{}
@@ -116,12 +552,32 @@ func (p *ChatRequestProcessor) TrimMessages() {
 	}
 
 	// 保留最新的N-1条非system消息（为system消息留一个位置）
-	if len(otherMsgs) > maxMsgs-1 && systemMsg != nil {
-		start := len(otherMsgs) - (maxMsgs - 1)
-		otherMsgs = otherMsgs[start:]
-	} else if len(otherMsgs) > maxMsgs {
-		// 如果没有system消息，则保留最新的N条消息
-		start := len(otherMsgs) - maxMsgs
+	// 如果没有system消息，则保留最新的N条消息
+	keep := maxMsgs
+	if systemMsg != nil {
+		keep = maxMsgs - 1
+	}
+
+	if keep < 1 && len(otherMsgs) > 0 {
+		// 限制过小时只剩system消息，Claude无法回答，额外保留最新的一条user消息
+		logger.Warn(fmt.Sprintf("Max limit (%d) leaves no conversation message, keeping the latest user message", maxMsgs))
+		latest := otherMsgs[len(otherMsgs)-1]
+		for i := len(otherMsgs) - 1; i >= 0; i-- {
+			if role, ok := otherMsgs[i]["role"].(string); ok && role == "user" {
+				latest = otherMsgs[i]
+				break
+			}
+		}
+		otherMsgs = []map[string]interface{}{latest}
+	} else if len(otherMsgs) > keep {
+		start := len(otherMsgs) - keep
+		// assistant 的 tool_calls 和之后的 tool 结果作为整体裁剪，不保留失去对应调用的 tool 结果
+		for start < len(otherMsgs)-1 {
+			if role, _ := otherMsgs[start]["role"].(string); role != "tool" {
+				break
+			}
+			start++
+		}
 		otherMsgs = otherMsgs[start:]
 	}
 
@@ -135,21 +591,121 @@ func (p *ChatRequestProcessor) TrimMessages() {
 	logger.Info(fmt.Sprintf("Messages trimmed to %d", len(p.Messages)))
 }
 
+// trimKeepingSystemInPlace 保留开头的system消息和最新的对话消息，保留范围内穿插的system消息留在原位置
+// 穿插的system消息不计入消息数量，保留范围之前的会被裁剪
+func (p *ChatRequestProcessor) trimKeepingSystemInPlace(maxMsgs int) {
+	leading := 0
+	for leading < len(p.Messages) {
+		if role, _ := p.Messages[leading]["role"].(string); role != "system" {
+			break
+		}
+		leading++
+	}
+	kept := append([]map[string]interface{}{}, p.Messages[:leading]...)
+	rest := p.Messages[leading:]
+
+	var conversation []int
+	for i, msg := range rest {
+		if role, _ := msg["role"].(string); role != "system" {
+			conversation = append(conversation, i)
+		}
+	}
+	keep := maxMsgs - len(kept)
+	if keep >= len(conversation) {
+		p.Messages = append(kept, rest...)
+		return
+	}
+
+	if keep < 1 {
+		// 限制过小时只剩system消息，Claude无法回答，额外保留最新的一条user消息
+		logger.Warn(fmt.Sprintf("Max limit (%d) leaves no conversation message, keeping the latest user message", maxMsgs))
+		latest := rest[conversation[len(conversation)-1]]
+		for i := len(conversation) - 1; i >= 0; i-- {
+			if role, _ := rest[conversation[i]]["role"].(string); role == "user" {
+				latest = rest[conversation[i]]
+				break
+			}
+		}
+		p.Messages = append(kept, latest)
+		return
+	}
+
+	start := conversation[len(conversation)-keep]
+	// 不保留失去对应调用的 tool 结果
+	for start < len(rest)-1 {
+		if role, _ := rest[start]["role"].(string); role != "tool" {
+			break
+		}
+		start++
+	}
+	p.Messages = append(kept, rest[start:]...)
+}
+
+// ShouldUseBigContext 判断是否需要把提示词作为 context.txt 文件上传
+// 提示词超过 MaxChatHistoryLength，或图片总字节数超过 BigContextImageBytes 时返回 true
+func (p *ChatRequestProcessor) ShouldUseBigContext() bool {
+	if p.Prompt.Len() > config.ConfigInstance.MaxChatHistoryLength {
+		return true
+	}
+	if config.ConfigInstance.BigContextImageBytes <= 0 {
+		return false
+	}
+	totalBytes := 0
+	for _, img := range p.ImgDataList {
+		if _, data, err := ParseDataURI(img); err == nil {
+			totalBytes += len(data)
+		}
+	}
+	if totalBytes > config.ConfigInstance.BigContextImageBytes {
+		logger.Info(fmt.Sprintf("Image bytes (%d) exceed big context threshold (%d)", totalBytes, config.ConfigInstance.BigContextImageBytes))
+		return true
+	}
+	return false
+}
+
 // ResetForBigContext resets the prompt for big context usage
 func (p *ChatRequestProcessor) ResetForBigContext() {
 	// 重置提示词
 	p.Prompt.Reset()
 
-	if config.ConfigInstance.PromptDisableArtifacts {
-		p.Prompt.WriteString("System: Forbidden to use <antArtifac> </antArtifac> to wrap code blocks, use markdown syntax instead, which means wrapping code blocks with ``` ```\n\n")
-	}
+	p.writeSystemPreamble()
 
-	// 添加大型上下文提示词
-	p.Prompt.WriteString(config.ConfigInstance.BigContextPrompt + "\n\n")
+	// 添加大型上下文提示词，单条超长用户消息使用面向文档分析的提示词
+	bigContextPrompt := config.ConfigInstance.BigContextPrompt
+	if p.isSingleLargeInput() {
+		logger.Info("Big context is dominated by a single user message, using single large input prompt")
+		bigContextPrompt = config.ConfigInstance.SingleLargeInputPrompt
+	}
+	p.Prompt.WriteString(bigContextPrompt + "\n\n")
+	if p.bigContextParts > 1 {
+		names := make([]string, p.bigContextParts)
+		for i := range names {
+			names[i] = BigContextFileName(i)
+		}
+		p.Prompt.WriteString(fmt.Sprintf("context.txt is split into %d files, read them in order: %s\n\n", p.bigContextParts, strings.Join(names, ", ")))
+	}
 
 	// 添加最后一个用户消息
 	// if p.LastUserMessage != "" {
 	// 	p.Prompt.WriteString(p.LastUserMessage)
 	// }
-	logger.Debug(fmt.Sprintf("ResetForBigContext: %s", p.Prompt.String()))
+	p.logPrompt("ResetForBigContext", p.Prompt.String())
+}
+
+// 单条用户消息占全部消息 token 数的比例达到该值时视为单条超长输入
+const singleLargeInputShare = 0.8
+
+// isSingleLargeInput 判断消息是否主要由一条超长的用户消息组成，而不是很长的对话历史
+func (p *ChatRequestProcessor) isSingleLargeInput() bool {
+	total, largest := 0, 0
+	largestRole := ""
+	for _, msg := range p.Messages {
+		tokens := EstimateTextTokens(contentText(msg["content"]))
+		total += tokens
+		if tokens > largest {
+			largest = tokens
+			largestRole, _ = msg["role"].(string)
+		}
+	}
+	return largestRole == "user" && total > 0 && float64(largest) >= float64(total)*singleLargeInputShare
 }
@@ -0,0 +1,621 @@
+package utils
+
+import (
+	"claude2api/config"
+	"claude2api/logger"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// contents 返回消息的 role:content 列表，便于比较
+func contents(msgs []map[string]interface{}) []string {
+	var out []string
+	for _, msg := range msgs {
+		role, _ := msg["role"].(string)
+		out = append(out, role+":"+contentText(msg["content"]))
+	}
+	return out
+}
+
+func TestTrimMessages(t *testing.T) {
+	history := messages(
+		"system", "Prompt",
+		"user", "u1",
+		"assistant", "a1",
+		"system", "Note1",
+		"user", "u2",
+		"system", "Note2",
+		"assistant", "a2",
+		"user", "u3",
+	)
+	tests := []struct {
+		name      string
+		mergeOnly bool
+		max       int
+		want      []string
+	}{
+		{"under limit", false, 10, contents(history)},
+		{"latest system moves to front", false, 4, []string{"system:Note2", "user:u2", "assistant:a2", "user:u3"}},
+		{"only system would remain", false, 1, []string{"system:Note2", "user:u3"}},
+		{"merge mode keeps notes in place", true, 4, []string{"system:Prompt", "user:u2", "system:Note2", "assistant:a2", "user:u3"}},
+		{"merge mode drops notes before the window", true, 3, []string{"system:Prompt", "assistant:a2", "user:u3"}},
+		{"merge mode keeps latest user when limit is tiny", true, 1, []string{"system:Prompt", "user:u3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.ConfigInstance.MergeContiguousSystemOnly, tt.mergeOnly)
+			setConfig(t, &config.ConfigInstance.MaxContextMessages, tt.max)
+			p := NewChatRequestProcessor()
+			p.Messages = history
+			p.TrimMessages()
+			if got := contents(p.Messages); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TrimMessages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeContiguousSystemMessages(t *testing.T) {
+	p := NewChatRequestProcessor()
+	p.Messages = messages("system", "A", "system", "B", "user", "u1", "system", "Note", "assistant", "a1", "system", "C", "system", "D")
+	p.Messages[3]["prefix"] = "Narrator: "
+	p.MergeContiguousSystemMessages()
+	want := []string{"system:A\n\nB", "user:u1", "system:Note", "assistant:a1", "system:C\n\nD"}
+	if got := contents(p.Messages); !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeContiguousSystemMessages() = %q, want %q", got, want)
+	}
+	if prefix := p.Messages[2]["prefix"]; prefix != "Narrator: " {
+		t.Errorf("unmerged system message prefix = %v, want it kept", prefix)
+	}
+}
+
+func TestLogPrompt(t *testing.T) {
+	prompt := strings.Repeat("abcdefghij", 10)
+	tests := []struct {
+		mode    string
+		chars   int
+		want    string
+		wantLog bool
+	}{
+		{"off", 20, "", false},
+		{"full", 20, "Prompt: " + prompt + "\n", true},
+		{"preview", 20, "Prompt (preview 20/100 chars): " + prompt[:20] + "...\n", true},
+		{"preview", 200, "Prompt: " + prompt + "\n", true},
+		{"preview", -1, "Prompt: " + prompt + "\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			setConfig(t, &config.ConfigInstance.DebugPromptMode, tt.mode)
+			setConfig(t, &config.ConfigInstance.DebugPromptPreviewChars, tt.chars)
+			logs := captureLogs(t)
+			p := NewChatRequestProcessor()
+			p.Debug = true
+			p.logPrompt("Prompt", prompt)
+
+			got := logs.String()
+			if !tt.wantLog {
+				if got != "" {
+					t.Errorf("logged %q, want nothing", got)
+				}
+				return
+			}
+			if !strings.HasSuffix(got, tt.want) {
+				t.Errorf("logged %q, want suffix %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNoTrim(t *testing.T) {
+	setConfig(t, &config.ConfigInstance.MaxContextMessages, 2)
+	history := messages("user", "u1", "assistant", "a1", "user", "u2", "assistant", "a2", "user", "u3")
+	tests := []struct {
+		name    string
+		noTrim  bool
+		hardMax int
+		want    int
+	}{
+		{"trimmed", false, 0, 2},
+		{"no_trim keeps all", true, 0, 5},
+		{"no_trim below hard max", true, 10, 5},
+		{"no_trim above hard max", true, 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.ConfigInstance.HardMaxMessages, tt.hardMax)
+			p := NewChatRequestProcessor()
+			p.NoTrim = tt.noTrim
+			p.Messages = history
+			p.TrimMessages()
+			if len(p.Messages) != tt.want {
+				t.Errorf("kept %d messages, want %d", len(p.Messages), tt.want)
+			}
+		})
+	}
+}
+
+// lenient 开启宽松的内容解析
+func lenient(t *testing.T) {
+	setConfig(t, &config.ConfigInstance.LenientContentParsing, true)
+}
+
+// hybridItem 构造同时带有 text 和 image_url 的内容块
+func hybridItem(itemType string) map[string]interface{} {
+	item := imageItem("https://example.com/a.png")
+	item["type"] = itemType
+	item["text"] = "Caption"
+	return item
+}
+
+func TestProcessContent(t *testing.T) {
+	tests := []struct {
+		name       string
+		setup      func(t *testing.T)
+		content    interface{}
+		wantPrompt string
+		wantImages int
+	}{
+		{"string", nil, "Hello", "Human: Hello\n\n", 0},
+		{"content array", nil, []interface{}{textItem("Hello"), textItem("again")}, "Human: Hello\n\nagain\n\n", 0},
+		{"single block object", nil, map[string]interface{}{"type": "text", "text": "Hello"}, "Human: Hello\n\n", 0},
+		{"single image object", nil, imageItem("https://example.com/a.png"), "Human: [Image 1]\n\n", 1},
+		{"value item ignored by default", nil, []interface{}{map[string]interface{}{"type": "input_text", "value": "Hello"}}, "", 0},
+		{"value item in lenient mode", lenient, []interface{}{map[string]interface{}{"type": "input_text", "value": "Hello"}}, "Human: Hello\n\n", 0},
+		{"text preferred over value", lenient, []interface{}{map[string]interface{}{"type": "output_text", "text": "Hello", "value": "ignored"}}, "Human: Hello\n\n", 0},
+		{"hybrid image item in strict mode", nil, []interface{}{hybridItem("image_url")}, "Human: [Image 1]\n\n", 1},
+		{"hybrid image item in lenient mode", lenient, []interface{}{hybridItem("image_url")}, "Human: Caption\n\n[Image 1]\n\n", 1},
+		{"hybrid text item in strict mode", nil, []interface{}{hybridItem("text")}, "Human: Caption\n\n", 0},
+		{"hybrid text item in lenient mode", lenient, []interface{}{hybridItem("text")}, "Human: Caption\n\n[Image 1]\n\n", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.ConfigInstance.GlobalSystemPrompt, "")
+			if tt.setup != nil {
+				tt.setup(t)
+			}
+			p := NewChatRequestProcessor()
+			err := p.ProcessMessages([]map[string]interface{}{{"role": "user", "content": tt.content}})
+			// wantPrompt 为空表示内容中没有可以回答的用户消息
+			if tt.wantPrompt == "" {
+				if !errors.Is(err, ErrNoUserMessage) {
+					t.Fatalf("ProcessMessages() error = %v, want ErrNoUserMessage", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.Prompt.String(); got != tt.wantPrompt {
+				t.Errorf("prompt = %q, want %q", got, tt.wantPrompt)
+			}
+			if len(p.ImgDataList) != tt.wantImages {
+				t.Errorf("got %d images, want %d", len(p.ImgDataList), tt.wantImages)
+			}
+		})
+	}
+}
+
+func TestShouldUseBigContext(t *testing.T) {
+	setConfig(t, &config.ConfigInstance.MaxChatHistoryLength, 1000)
+	img := pngDataURI(t, 50, 50)
+	_, data, _ := ParseDataURI(img)
+
+	tests := []struct {
+		name       string
+		prompt     string
+		images     []string
+		imageBytes int
+		want       bool
+	}{
+		{"short text", "Hi", nil, 0, false},
+		{"long text", strings.Repeat("x", 1001), nil, 0, true},
+		{"images under threshold", "Hi", []string{img}, len(data) * 2, false},
+		{"image heavy", "Hi", []string{img, img}, len(data)*2 - 1, true},
+		{"image threshold disabled", "Hi", []string{img, img}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.ConfigInstance.BigContextImageBytes, tt.imageBytes)
+			p := NewChatRequestProcessor()
+			p.Prompt.WriteString(tt.prompt)
+			p.ImgDataList = tt.images
+			if got := p.ShouldUseBigContext(); got != tt.want {
+				t.Errorf("ShouldUseBigContext() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLastUserMessage(t *testing.T) {
+	img := pngDataURI(t, 1, 1)
+	tests := []struct {
+		name       string
+		content    interface{}
+		wantLast   string
+		wantImages int
+	}{
+		{"text", "Hello", "Human: Hello\n\n", 0},
+		{"empty text with image", []interface{}{textItem(""), imageItem(img)}, "Human: [Image 1]\n\n", 1},
+		{"whitespace text does not overwrite", []interface{}{textItem("Look"), textItem("  "), imageItem(img)}, "Human: Look\n\n", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewChatRequestProcessor()
+			msgs := []map[string]interface{}{
+				{"role": "user", "content": tt.content},
+				{"role": "assistant", "content": "Nice"},
+			}
+			if err := p.ProcessMessages(msgs); err != nil {
+				t.Fatal(err)
+			}
+			if p.LastUserMessage != tt.wantLast {
+				t.Errorf("LastUserMessage = %q, want %q", p.LastUserMessage, tt.wantLast)
+			}
+			if len(p.ImgDataList) != tt.wantImages {
+				t.Errorf("got %d images, want %d", len(p.ImgDataList), tt.wantImages)
+			}
+		})
+	}
+}
+
+func TestRolePrefixOverride(t *testing.T) {
+	msgs := messages("user", "Hi", "assistant", "Hello", "user", "Who are you?")
+	msgs[1]["prefix"] = "Narrator: "
+	p := NewChatRequestProcessor()
+	if err := p.ProcessMessages(msgs); err != nil {
+		t.Fatal(err)
+	}
+	want := "Human: Hi\n\nNarrator: Hello\n\nHuman: Who are you?\n\n"
+	if got := p.Prompt.String(); got != want {
+		t.Errorf("prompt = %q, want %q", got, want)
+	}
+}
+
+func TestTrailingBlankUser(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		msgs     []map[string]interface{}
+		wantErr  error
+		wantLast string
+	}{
+		{"drop falls back to previous user", "drop", messages("user", "Hi", "assistant", "Hello", "user", " \n\t "), nil, "Human: Hi\n\n"},
+		{"drop removes every blank turn", "drop", messages("user", "Hi", "assistant", "Hello", "user", " ", "user", ""), nil, "Human: Hi\n\n"},
+		{"error policy", "error", messages("user", "Hi", "assistant", "Hello", "user", " \n "), ErrNoUserMessage, ""},
+		{"drop leaves no user message", "drop", messages("user", "  "), ErrNoUserMessage, ""},
+		{"drop leaves only system", "drop", messages("system", "Be brief.", "user", "\n"), ErrNoUserMessage, ""},
+		{"drop leaves only blank users", "drop", messages("user", " ", "assistant", "Hello", "user", ""), ErrNoUserMessage, ""},
+		{"image-only turn is kept", "error", []map[string]interface{}{{"role": "user", "content": []interface{}{textItem(" "), imageItem("https://example.com/a.png")}}}, nil, "Human: [Image 1]\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.ConfigInstance.TrailingBlankUserPolicy, tt.policy)
+			p := NewChatRequestProcessor()
+			err := p.ProcessMessages(tt.msgs)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ProcessMessages() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && p.LastUserMessage != tt.wantLast {
+				t.Errorf("LastUserMessage = %q, want %q", p.LastUserMessage, tt.wantLast)
+			}
+		})
+	}
+}
+
+func TestInstructions(t *testing.T) {
+	tests := []struct {
+		name      string
+		mergeOnly bool
+		msgs      []map[string]interface{}
+	}{
+		{"no system message", false, messages("user", "Hi")},
+		{"merged with leading system", true, messages("system", "Be brief.", "user", "Hi")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.ConfigInstance.MergeContiguousSystemOnly, tt.mergeOnly)
+			withInstructions := NewChatRequestProcessor()
+			withInstructions.Instructions = "Answer in English."
+			if err := withInstructions.ProcessMessages(tt.msgs); err != nil {
+				t.Fatal(err)
+			}
+			asSystem := NewChatRequestProcessor()
+			if err := asSystem.ProcessMessages(append(messages("system", "Answer in English."), tt.msgs...)); err != nil {
+				t.Fatal(err)
+			}
+			got := withInstructions.Prompt.String()
+			if want := asSystem.Prompt.String(); got != want {
+				t.Errorf("prompt = %q, want %q", got, want)
+			}
+			if !strings.HasPrefix(got, "System: Answer in English.") {
+				t.Errorf("prompt = %q, want instructions first", got)
+			}
+		})
+	}
+}
+
+func TestAssistantToolCalls(t *testing.T) {
+	toolCalls := []interface{}{map[string]interface{}{
+		"id":       "call_1",
+		"type":     "function",
+		"function": map[string]interface{}{"name": "weather", "arguments": `{"city":"Paris"}`},
+	}}
+	const toolCallsJSON = `[{"function":{"arguments":"{\"city\":\"Paris\"}","name":"weather"},"id":"call_1","type":"function"}]`
+	tests := []struct {
+		name      string
+		assistant map[string]interface{}
+		want      string
+	}{
+		{"text and tool calls", map[string]interface{}{"role": "assistant", "content": "Let me check.", "tool_calls": toolCalls}, "Assistant: Let me check.\n\n" + toolCallsJSON + "\n\n"},
+		{"tool calls without content", map[string]interface{}{"role": "assistant", "tool_calls": toolCalls}, "Assistant: " + toolCallsJSON + "\n\n"},
+		{"text only", map[string]interface{}{"role": "assistant", "content": "Sunny."}, "Assistant: Sunny.\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewChatRequestProcessor()
+			msgs := []map[string]interface{}{{"role": "user", "content": "Weather?"}, tt.assistant}
+			if err := p.ProcessMessages(msgs); err != nil {
+				t.Fatal(err)
+			}
+			want := "Human: Weather?\n\n" + tt.want
+			if got := p.Prompt.String(); got != want {
+				t.Errorf("prompt = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestImagePositionInTurn(t *testing.T) {
+	content := []interface{}{textItem("First"), imageItem("https://example.com/a.png"), textItem("Second"), imageItem("https://example.com/b.png")}
+	tests := []struct {
+		position string
+		want     string
+	}{
+		{"after", "Human: First\n\nSecond\n\n[Image 1]\n\n[Image 2]\n\n"},
+		{"before", "Human: [Image 1]\n\n[Image 2]\n\nFirst\n\nSecond\n\n"},
+		{"inline", "Human: First\n\n[Image 1]\n\nSecond\n\n[Image 2]\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.position, func(t *testing.T) {
+			setConfig(t, &config.ConfigInstance.ImagePositionInTurn, tt.position)
+			p := NewChatRequestProcessor()
+			if err := p.ProcessMessages([]map[string]interface{}{{"role": "user", "content": content}}); err != nil {
+				t.Fatal(err)
+			}
+			if got := p.Prompt.String(); got != tt.want {
+				t.Errorf("prompt = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeepLatestImageOnly(t *testing.T) {
+	msgs := []map[string]interface{}{
+		{"role": "user", "content": []interface{}{textItem("Old"), imageItem("https://example.com/old.png")}},
+		{"role": "assistant", "content": "Seen."},
+		{"role": "user", "content": []interface{}{textItem("New"), imageItem("https://example.com/new.png")}},
+		{"role": "assistant", "content": "Seen."},
+		{"role": "user", "content": "Compare them."},
+	}
+	tests := []struct {
+		name       string
+		latestOnly bool
+		wantImages []string
+		wantPrompt string
+	}{
+		{"all images", false, []string{"https://example.com/old.png", "https://example.com/new.png"}, "Human: Old\n\n[Image 1]\n\n"},
+		{"latest image only", true, []string{"https://example.com/new.png"}, "Human: Old\n\n" + ImagePlaceholder + "\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.ConfigInstance.KeepLatestImageOnly, tt.latestOnly)
+			p := NewChatRequestProcessor()
+			if err := p.ProcessMessages(msgs); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(p.ImgDataList, tt.wantImages) {
+				t.Errorf("images = %v, want %v", p.ImgDataList, tt.wantImages)
+			}
+			if got := p.Prompt.String(); !strings.HasPrefix(got, tt.wantPrompt) {
+				t.Errorf("prompt = %q, want prefix %q", got, tt.wantPrompt)
+			}
+		})
+	}
+}
+
+func TestResetForBigContextPrompt(t *testing.T) {
+	setConfig(t, &config.ConfigInstance.BigContextPrompt, "Read context.txt.")
+	setConfig(t, &config.ConfigInstance.SingleLargeInputPrompt, "Analyze the document in context.txt.")
+	document := strings.Repeat("word ", 2000)
+	var history []string
+	for i := 0; i < 20; i++ {
+		history = append(history, "user", strings.Repeat("question ", 50), "assistant", strings.Repeat("answer ", 50))
+	}
+	tests := []struct {
+		name string
+		msgs []map[string]interface{}
+		want string
+	}{
+		{"single large user message", messages("user", document, "assistant", "OK", "user", "Summarize it."), "Analyze the document in context.txt.\n\n"},
+		{"long history", messages(history...), "Read context.txt.\n\n"},
+		{"large assistant message", messages("user", "Write an essay.", "assistant", document), "Read context.txt.\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewChatRequestProcessor()
+			p.Messages = tt.msgs
+			p.ResetForBigContext()
+			if got := p.Prompt.String(); got != tt.want {
+				t.Errorf("prompt = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeTrailingUserMessages(t *testing.T) {
+	img := imageItem("https://example.com/a.png")
+	tests := []struct {
+		name string
+		msgs []map[string]interface{}
+		want []map[string]interface{}
+	}{
+		{"single trailing user unchanged", messages("user", "Hi", "assistant", "Hello", "user", "Question"), messages("user", "Hi", "assistant", "Hello", "user", "Question")},
+		{"three trailing users merged", messages("user", "Hi", "assistant", "Hello", "user", "Part one", "user", "Part two", "user", "Part three"),
+			messages("user", "Hi", "assistant", "Hello", "user", "Part one\n\nPart two\n\nPart three")},
+		{"images kept after text", []map[string]interface{}{
+			{"role": "assistant", "content": "Hello"},
+			{"role": "user", "content": []interface{}{textItem("Look"), img}},
+			{"role": "user", "content": "  "},
+			{"role": "user", "content": "What is it?"},
+		}, []map[string]interface{}{
+			{"role": "assistant", "content": "Hello"},
+			{"role": "user", "content": []interface{}{textItem("Look\n\nWhat is it?"), img}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewChatRequestProcessor()
+			p.Messages = tt.msgs
+			p.MergeTrailingUserMessages()
+			if !reflect.DeepEqual(p.Messages, tt.want) {
+				t.Errorf("MergeTrailingUserMessages() = %v, want %v", p.Messages, tt.want)
+			}
+		})
+	}
+}
+
+func TestPerRequestDebug(t *testing.T) {
+	level := logger.GetLevel()
+	logger.SetLevel(logger.INFO)
+	t.Cleanup(func() { logger.SetLevel(level) })
+	logs := captureLogs(t)
+	const requests = 10
+	tests := []struct {
+		text      string
+		debug     bool
+		wantCount int
+	}{
+		{"debug-on", true, requests},
+		{"debug-off", false, 0},
+	}
+	var wg sync.WaitGroup
+	for _, tt := range tests {
+		for i := 0; i < requests; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p := NewChatRequestProcessor()
+				p.Debug = tt.debug
+				if err := p.ProcessMessages(messages("user", tt.text)); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	for _, tt := range tests {
+		want := "LastUserMessage: Human: " + tt.text
+		if got := strings.Count(logs.String(), want); got != tt.wantCount {
+			t.Errorf("%q logged %d times, want %d", tt.text, got, tt.wantCount)
+		}
+	}
+}
+
+func TestImagesOnlyTurnWithDroppedImages(t *testing.T) {
+	setConfig(t, &config.ConfigInstance.AllowedImageMimeTypes, []string{"image/png"})
+	tests := []struct {
+		name       string
+		content    []interface{}
+		wantPrompt string
+		wantLast   string
+		wantImages int
+	}{
+		{"all images dropped", []interface{}{imageItem(bmpDataURI()), imageItem(bmpDataURI())}, "Human: " + ImagePlaceholder + "\n\n", "Human: " + ImagePlaceholder + "\n\n", 0},
+		{"empty text and dropped image", []interface{}{textItem(""), imageItem(bmpDataURI())}, "Human: \n\n" + ImagePlaceholder + "\n\n", "Human: " + ImagePlaceholder + "\n\n", 0},
+		{"one image kept", []interface{}{imageItem(bmpDataURI()), imageItem(pngDataURI(t, 1, 1))}, "Human: [Image 1]\n\n", "Human: [Image 1]\n\n", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewChatRequestProcessor()
+			if err := p.ProcessMessages([]map[string]interface{}{{"role": "user", "content": tt.content}}); err != nil {
+				t.Fatal(err)
+			}
+			if got := p.Prompt.String(); got != tt.wantPrompt {
+				t.Errorf("prompt = %q, want %q", got, tt.wantPrompt)
+			}
+			if len(p.ImgDataList) != tt.wantImages {
+				t.Errorf("got %d images, want %d", len(p.ImgDataList), tt.wantImages)
+			}
+			if p.LastUserMessage != tt.wantLast {
+				t.Errorf("LastUserMessage = %q, want %q", p.LastUserMessage, tt.wantLast)
+			}
+		})
+	}
+}
+
+func TestTrimMessagesKeepsToolPairs(t *testing.T) {
+	history := []map[string]interface{}{
+		{"role": "system", "content": "Prompt"},
+		{"role": "user", "content": "Weather in Paris and Rome?"},
+		{"role": "assistant", "content": "Checking.", "tool_calls": []interface{}{map[string]interface{}{"id": "call_1"}, map[string]interface{}{"id": "call_2"}}},
+		{"role": "tool", "tool_call_id": "call_1", "content": "Sunny"},
+		{"role": "tool", "tool_call_id": "call_2", "content": "Rainy"},
+		{"role": "assistant", "content": "Sunny and rainy."},
+		{"role": "user", "content": "Thanks"},
+	}
+	tests := []struct {
+		name      string
+		mergeOnly bool
+		max       int
+		want      []string
+	}{
+		{"pair kept whole", false, 6, []string{"system:Prompt", "assistant:Checking.", "tool:Sunny", "tool:Rainy", "assistant:Sunny and rainy.", "user:Thanks"}},
+		{"cut at first tool result", false, 5, []string{"system:Prompt", "assistant:Sunny and rainy.", "user:Thanks"}},
+		{"cut at second tool result", false, 4, []string{"system:Prompt", "assistant:Sunny and rainy.", "user:Thanks"}},
+		{"merge mode cut at first tool result", true, 5, []string{"system:Prompt", "assistant:Sunny and rainy.", "user:Thanks"}},
+		{"merge mode cut at second tool result", true, 4, []string{"system:Prompt", "assistant:Sunny and rainy.", "user:Thanks"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.ConfigInstance.MergeContiguousSystemOnly, tt.mergeOnly)
+			setConfig(t, &config.ConfigInstance.MaxContextMessages, tt.max)
+			p := NewChatRequestProcessor()
+			p.Messages = history
+			p.TrimMessages()
+			if got := contents(p.Messages); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TrimMessages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWarnPromptTokens(t *testing.T) {
+	tests := []struct {
+		name     string
+		warn     int
+		max      int
+		tokens   int
+		wantWarn bool
+	}{
+		{"disabled", 0, 0, 500, false},
+		{"below threshold", 100, 0, 100, false},
+		{"above threshold", 100, 0, 101, true},
+		{"between threshold and max", 100, 200, 150, true},
+		{"above max", 100, 200, 201, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.ConfigInstance.WarnPromptTokens, tt.warn)
+			setConfig(t, &config.ConfigInstance.MaxPromptTokens, tt.max)
+			logs := captureLogs(t)
+			NewChatRequestProcessor().warnPromptTokens(tt.tokens)
+			if got := strings.Contains(logs.String(), "Prompt is approaching the context limit"); got != tt.wantWarn {
+				t.Errorf("warned = %v, want %v (logs %q)", got, tt.wantWarn, logs.String())
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package utils
 
 import (
 	"claude2api/config"
+	"slices"
+	"strings"
 )
 
 // **获取角色前缀**
@@ -20,3 +22,32 @@ func GetRolePrefix(role string) string {
 		return "Unknown: "
 	}
 }
+
+// StopSequences 合并角色前缀停止词与客户端的 stop 参数，并去除重复的停止词
+// 客户端的 stop 可以是字符串或字符串数组
+// 相互包含的停止词都会保留，由输出时最先命中的位置决定截断点
+func StopSequences(clientStop interface{}) []string {
+	var candidates []string
+	if !config.ConfigInstance.NoRolePrefix && config.ConfigInstance.StopOnHumanTurn {
+		// Claude 续写出新的 Human 轮次时停止
+		candidates = append(candidates, "\n"+strings.TrimSpace(GetRolePrefix("user")))
+	}
+	switch v := clientStop.(type) {
+	case string:
+		candidates = append(candidates, v)
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				candidates = append(candidates, s)
+			}
+		}
+	}
+
+	var stops []string
+	for _, candidate := range candidates {
+		if candidate != "" && !slices.Contains(stops, candidate) {
+			stops = append(stops, candidate)
+		}
+	}
+	return stops
+}
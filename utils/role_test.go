@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"claude2api/config"
+	"reflect"
+	"testing"
+)
+
+func TestStopSequences(t *testing.T) {
+	tests := []struct {
+		name         string
+		noRolePrefix bool
+		humanStop    bool
+		stop         interface{}
+		want         []string
+	}{
+		{"role prefix only", false, true, nil, []string{"\nHuman:"}},
+		{"client string", false, true, "END", []string{"\nHuman:", "END"}},
+		{"client contains role prefix", false, true, []interface{}{"\nHuman: next", "END"}, []string{"\nHuman:", "\nHuman: next", "END"}},
+		{"client inside role prefix", false, true, []interface{}{"Human:"}, []string{"\nHuman:", "Human:"}},
+		{"duplicates", false, true, []interface{}{"END", "END", ""}, []string{"\nHuman:", "END"}},
+		{"no role prefix", true, true, "END", []string{"END"}},
+		{"human stop disabled", false, false, nil, nil},
+		{"human stop disabled with client stop", false, false, "END", []string{"END"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.ConfigInstance.NoRolePrefix, tt.noRolePrefix)
+			setConfig(t, &config.ConfigInstance.StopOnHumanTurn, tt.humanStop)
+			if got := StopSequences(tt.stop); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("StopSequences(%q) = %q, want %q", tt.stop, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"claude2api/config"
+	"claude2api/logger"
+	"fmt"
+	"strings"
+)
+
+// 被截断的 system 内容末尾添加的标记
+const systemTruncatedMarker = "\n[system content truncated]"
+
+// LimitSystemTokens 限制 system 内容（全局提示词和客户端的 system 消息）的总 token 数
+// 超出 MaxSystemTokens 时按 SystemPromptPriority 分配预算，优先级低的内容先被截断
+func (p *ChatRequestProcessor) LimitSystemTokens() {
+	maxTokens := config.ConfigInstance.MaxSystemTokens
+	if maxTokens <= 0 {
+		return
+	}
+
+	budget := maxTokens * 4
+	var truncated []string
+	for _, source := range config.ConfigInstance.SystemPromptPriority {
+		switch source {
+		case "global":
+			text, remaining := truncateToBudget(p.globalSystem, budget)
+			if text != p.globalSystem {
+				truncated = append(truncated, source)
+			}
+			p.globalSystem, budget = text, remaining
+		case "client":
+			var messages []map[string]interface{}
+			changed := false
+			for _, msg := range p.Messages {
+				if role, ok := msg["role"].(string); !ok || role != "system" {
+					messages = append(messages, msg)
+					continue
+				}
+				content := contentText(msg["content"])
+				text, remaining := truncateToBudget(content, budget)
+				budget = remaining
+				if text == content {
+					messages = append(messages, msg)
+					continue
+				}
+				changed = true
+				if text != "" {
+					// 只替换内容，保留 prefix 等其他字段
+					copied := make(map[string]interface{}, len(msg))
+					for key, value := range msg {
+						copied[key] = value
+					}
+					copied["content"] = text
+					messages = append(messages, copied)
+				}
+			}
+			if changed {
+				truncated = append(truncated, source)
+				p.Messages = messages
+			}
+		}
+	}
+
+	if len(truncated) > 0 {
+		logger.Warn(fmt.Sprintf("System content exceeds max system tokens (%d), truncated: %v", maxTokens, truncated))
+	}
+}
+
+// truncateToBudget 按字符预算截断文本，返回截断后的文本和剩余预算
+// 预算用完时返回空字符串
+func truncateToBudget(text string, budget int) (string, int) {
+	runes := []rune(text)
+	if len(runes) <= budget {
+		return text, budget - len(runes)
+	}
+	if budget <= 0 {
+		return "", 0
+	}
+	return string(runes[:budget]) + systemTruncatedMarker, 0
+}
+
+// AddSystemPrompt 在处理完消息后追加一段 system 提示词并重新生成提示词
+// position 为 end 时放在最后一条消息之后，否则放在所有消息之前
+// 提示词不加入消息列表，不会被 TrimMessages 裁剪或移动，重新生成的提示词同样按 MaxPromptTokens 检查
+func (p *ChatRequestProcessor) AddSystemPrompt(text string, position string) error {
+	if position == "end" {
+		p.endSystemPrompts = append(p.endSystemPrompts, text)
+	} else {
+		p.startSystemPrompts = append(p.startSystemPrompts, text)
+	}
+
+	p.reset()
+	return p.ProcessMessages(p.inputMessages)
+}
+
+// reset 清空处理结果，用于重新生成提示词
+func (p *ChatRequestProcessor) reset() {
+	p.Prompt.Reset()
+	p.RootPrompt.Reset()
+	p.ImgDataList = []string{}
+	p.LastUserMessage = ""
+	p.globalSystem = ""
+	p.foldedContent = nil
+	// 重新生成的提示词需要重新检查大小和拆分
+	p.truncatedUser = ""
+	p.bigContextParts = 0
+}
+
+// FoldSystemIntoFirstUser 把代理添加的提示词、所有 system 消息和回复语言要求合并后放到第一条用户消息的开头，不再单独输出 System 轮次
+// AddSystemPrompt 以 end 添加的提示词放在最后一条用户消息的末尾
+// p.Messages 保持不变，写入提示词时跳过 system 消息并使用合并后的用户消息内容，没有用户消息时不做处理
+func (p *ChatRequestProcessor) FoldSystemIntoFirstUser() {
+	first, last := -1, -1
+	texts := p.systemPreamble()
+	for i, msg := range p.Messages {
+		role, _ := msg["role"].(string)
+		if role == "system" {
+			if text := contentText(msg["content"]); strings.TrimSpace(text) != "" {
+				texts = append(texts, text)
+			}
+			continue
+		}
+		if role == "user" {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if language := p.responseLanguage(); language != "" {
+		texts = append(texts, fmt.Sprintf("Respond in %s.", language))
+	}
+	if first < 0 {
+		return
+	}
+
+	p.foldedContent = map[int]interface{}{}
+	if len(texts) > 0 {
+		p.foldedContent[first] = addContentText(p.Messages[first]["content"], strings.Join(texts, "\n\n"), false)
+	}
+	if len(p.endSystemPrompts) > 0 {
+		content, ok := p.foldedContent[last]
+		if !ok {
+			content = p.Messages[last]["content"]
+		}
+		p.foldedContent[last] = addContentText(content, strings.Join(p.endSystemPrompts, "\n\n"), true)
+	}
+}
+
+// addContentText 在消息内容的开头或末尾添加文本，数组内容作为单独的文本项添加
+func addContentText(content interface{}, text string, atEnd bool) interface{} {
+	item := map[string]interface{}{"type": "text", "text": text}
+	var items []interface{}
+	switch v := content.(type) {
+	case []interface{}:
+		items = v
+	case map[string]interface{}:
+		items = []interface{}{v}
+	default:
+		if atEnd {
+			return contentText(v) + "\n\n" + text
+		}
+		return text + "\n\n" + contentText(v)
+	}
+	if atEnd {
+		return append(append([]interface{}{}, items...), item)
+	}
+	return append([]interface{}{item}, items...)
+}
@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"claude2api/config"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAddSystemPromptSurvivesTrimming(t *testing.T) {
+	setConfig(t, &config.ConfigInstance.MaxContextMessages, 3)
+	setConfig(t, &config.ConfigInstance.GlobalSystemPrompt, "")
+
+	tests := []struct {
+		position string
+		want     string
+	}{
+		{"start", "System: Added.\n\nSystem: Client.\n\nHuman: Hi\n\nAssistant: Hello\n\n"},
+		{"end", "System: Client.\n\nHuman: Hi\n\nAssistant: Hello\n\nSystem: Added.\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.position, func(t *testing.T) {
+			p := NewChatRequestProcessor()
+			if err := p.ProcessMessages(messages("system", "Client.", "user", "Hi", "assistant", "Hello")); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.AddSystemPrompt("Added.", tt.position); err != nil {
+				t.Fatal(err)
+			}
+			if got := p.Prompt.String(); got != tt.want {
+				t.Errorf("prompt = %q, want %q", got, tt.want)
+			}
+			if got := p.RootPrompt.String(); got != tt.want {
+				t.Errorf("root prompt = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddSystemPromptKeepsEarlierPrompts(t *testing.T) {
+	setConfig(t, &config.ConfigInstance.GlobalSystemPrompt, "")
+
+	p := NewChatRequestProcessor()
+	if err := p.ProcessMessages(messages("user", "Hi")); err != nil {
+		t.Fatal(err)
+	}
+	p.AddSystemPrompt("First.", "start")
+	p.AddSystemPrompt("Second.", "start")
+	want := "System: First.\n\nSystem: Second.\n\nHuman: Hi\n\n"
+	if got := p.Prompt.String(); !strings.HasPrefix(got, want) {
+		t.Errorf("prompt = %q, want prefix %q", got, want)
+	}
+}
+
+func TestAddSystemPromptChecksSize(t *testing.T) {
+	setConfig(t, &config.ConfigInstance.MaxPromptTokens, 100)
+	setConfig(t, &config.ConfigInstance.GlobalSystemPrompt, "")
+
+	long := "HEAD " + strings.Repeat("middle words ", 200) + " TAIL"
+	added := strings.Repeat("rule ", 40)
+	tests := []struct {
+		name    string
+		policy  string
+		message string
+		wantErr bool
+	}{
+		{"error rejects prompt pushed over the limit", "error", strings.Repeat("question ", 40), true},
+		{"truncate fits again after earlier truncation", "truncate", long, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.ConfigInstance.OversizedUserPolicy, tt.policy)
+			p := NewChatRequestProcessor()
+			if err := p.ProcessMessages(messages("user", tt.message)); err != nil {
+				t.Fatal(err)
+			}
+			p.bigContextParts = 3
+			err := p.AddSystemPrompt(added, "start")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AddSystemPrompt() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if p.bigContextParts != 0 {
+				t.Errorf("bigContextParts = %d, want 0 after reset", p.bigContextParts)
+			}
+			if tt.wantErr {
+				return
+			}
+			if tokens := p.EstimateTokens(); tokens > 100 {
+				t.Errorf("EstimateTokens() = %d, want <= 100", tokens)
+			}
+			if !strings.Contains(p.Prompt.String(), strings.TrimSpace(added)) {
+				t.Errorf("prompt lost the added system prompt: %q", p.Prompt.String())
+			}
+		})
+	}
+}
+
+func TestFoldSystemIntoFirstUser(t *testing.T) {
+	setConfig(t, &config.ConfigInstance.FoldSystemIntoFirstUser, true)
+	setConfig(t, &config.ConfigInstance.GlobalSystemPrompt, "Be brief.")
+	setConfig(t, &config.ConfigInstance.PromptDisableArtifacts, true)
+	setConfig(t, &config.ConfigInstance.RequestValidations, []string{"system"})
+
+	p := NewChatRequestProcessor()
+	p.Language = "Chinese"
+	err := p.ProcessMessages(messages("system", "You are a secret internal bot", "user", "Hello there", "assistant", "Hi", "user", "Bye"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prompt := p.Prompt.String()
+	if strings.Contains(prompt, "System:") {
+		t.Errorf("prompt has a System turn: %q", prompt)
+	}
+	for _, want := range []string{"Forbidden to use", "Be brief.", "You are a secret internal bot", "Respond in Chinese.", "Hello there"} {
+		if !strings.HasPrefix(prompt, "Human: ") || !strings.Contains(prompt[:strings.Index(prompt, "Assistant: ")], want) {
+			t.Errorf("first user turn of %q does not contain %q", prompt, want)
+		}
+	}
+	if got := p.DeriveTitle(50); got != "Hello there" {
+		t.Errorf("title = %q, want %q", got, "Hello there")
+	}
+	if err := p.Validate(); err != nil {
+		t.Errorf("Validate() = %v, want nil", err)
+	}
+
+	if err := p.AddSystemPrompt("Answer last.", "end"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := p.Prompt.String(), "Human: Bye\n\nAnswer last.\n\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("prompt = %q, want suffix %q", got, want)
+	}
+}
+
+func TestGlobalSystemPrompt(t *testing.T) {
+	setConfig(t, &config.ConfigInstance.GlobalSystemPrompt, "Be brief.")
+	tests := []struct {
+		name string
+		skip bool
+		want string
+	}{
+		{"added", false, "System: Be brief.\n\nHuman: Hi\n\n"},
+		{"skipped", true, "Human: Hi\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewChatRequestProcessor()
+			p.SkipGlobalSystem = tt.skip
+			if err := p.ProcessMessages(messages("user", "Hi")); err != nil {
+				t.Fatal(err)
+			}
+			if got := p.Prompt.String(); got != tt.want {
+				t.Errorf("prompt = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitSystemTokens(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxTokens  int
+		priority   []string
+		wantGlobal string
+		want       []string
+	}{
+		{"unlimited", 0, []string{"global", "client"}, "Be brief.", []string{"system:Only English.", "user:Hi"}},
+		{"global first", 2, []string{"global", "client"}, "Be brief" + systemTruncatedMarker, []string{"user:Hi"}},
+		{"client first", 2, []string{"client", "global"}, "", []string{"system:Only Eng" + systemTruncatedMarker, "user:Hi"}},
+		{"both fit", 10, []string{"global", "client"}, "Be brief.", []string{"system:Only English.", "user:Hi"}},
+		{"second truncated", 5, []string{"global", "client"}, "Be brief.", []string{"system:Only Englis" + systemTruncatedMarker, "user:Hi"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.ConfigInstance.MaxSystemTokens, tt.maxTokens)
+			setConfig(t, &config.ConfigInstance.SystemPromptPriority, tt.priority)
+			p := NewChatRequestProcessor()
+			p.globalSystem = "Be brief."
+			p.Messages = messages("system", "Only English.", "user", "Hi")
+			p.Messages[0]["prefix"] = "Rules: "
+			p.LimitSystemTokens()
+			if p.globalSystem != tt.wantGlobal {
+				t.Errorf("global system = %q, want %q", p.globalSystem, tt.wantGlobal)
+			}
+			if got := contents(p.Messages); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("messages = %q, want %q", got, tt.want)
+			}
+			if role, _ := p.Messages[0]["role"].(string); role == "system" && p.Messages[0]["prefix"] != "Rules: " {
+				t.Errorf("system message prefix = %v, want it kept", p.Messages[0]["prefix"])
+			}
+		})
+	}
+}
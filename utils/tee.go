@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"claude2api/config"
+	"claude2api/logger"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// PromptTee 把最终的提示词异步写入额外的输出，用于离线分析
+// 写入在后台协程中完成，缓冲区满时丢弃记录，不会阻塞请求
+type PromptTee struct {
+	records chan string
+	done    chan struct{}
+}
+
+// NewPromptTee 创建写入 w 的 PromptTee，bufferSize 为最多缓存的提示词数量
+func NewPromptTee(w io.Writer, bufferSize int) *PromptTee {
+	t := &PromptTee{
+		records: make(chan string, bufferSize),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(t.done)
+		for record := range t.records {
+			if _, err := io.WriteString(w, record); err != nil {
+				logger.Error(fmt.Sprintf("Failed to write prompt tee: %v", err))
+			}
+		}
+	}()
+	return t
+}
+
+// Write 提交一条提示词记录，缓冲区满时直接丢弃
+func (t *PromptTee) Write(prompt string) {
+	record := fmt.Sprintf("===== %s =====\n%s\n", time.Now().Format(time.RFC3339), prompt)
+	select {
+	case t.records <- record:
+	default:
+		logger.Warn("Prompt tee buffer is full, dropping prompt")
+	}
+}
+
+// Close 等待缓冲的记录写完
+func (t *PromptTee) Close() {
+	close(t.records)
+	<-t.done
+}
+
+var (
+	promptTee     *PromptTee
+	promptTeeOnce sync.Once
+)
+
+// TeePrompt 在配置了 PromptTeePath 时把提示词写入该文件
+func TeePrompt(prompt string) {
+	if config.ConfigInstance.PromptTeePath == "" {
+		return
+	}
+	promptTeeOnce.Do(func() {
+		file, err := os.OpenFile(config.ConfigInstance.PromptTeePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to open prompt tee file: %v", err))
+			return
+		}
+		promptTee = NewPromptTee(file, 100)
+	})
+	if promptTee != nil {
+		promptTee.Write(prompt)
+	}
+}
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// blockingWriter 在 release 关闭之前阻塞写入
+type blockingWriter struct {
+	release chan struct{}
+	buf     bytes.Buffer
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.buf.Write(p)
+}
+
+func TestPromptTee(t *testing.T) {
+	var buf bytes.Buffer
+	tee := NewPromptTee(&buf, 10)
+	tee.Write("Human: Hi\n\n")
+	tee.Write("Human: Bye\n\n")
+	tee.Close()
+
+	records := strings.Split(buf.String(), "===== ")
+	if len(records) != 3 {
+		t.Fatalf("got %d records, want 2: %q", len(records)-1, buf.String())
+	}
+	for i, want := range []string{"Human: Hi\n\n", "Human: Bye\n\n"} {
+		if !strings.HasSuffix(records[i+1], " =====\n"+want+"\n") {
+			t.Errorf("record %d = %q, want prompt %q", i, records[i+1], want)
+		}
+	}
+}
+
+func TestPromptTeeDropsWhenFull(t *testing.T) {
+	w := &blockingWriter{release: make(chan struct{})}
+	tee := NewPromptTee(w, 1)
+	logs := captureLogs(t)
+	// 后台协程可能已经取走第一条记录并阻塞在写入上，多写几条确保缓冲区被填满
+	for i := 0; i < 3; i++ {
+		tee.Write("Human: Hi\n\n")
+	}
+	close(w.release)
+	tee.Close()
+
+	if !strings.Contains(logs.String(), "Prompt tee buffer is full") {
+		t.Errorf("logs = %q, want a dropped prompt warning", logs.String())
+	}
+	if got := strings.Count(w.buf.String(), "Human: Hi"); got < 1 || got > 2 {
+		t.Errorf("wrote %d prompts, want 1 or 2", got)
+	}
+}
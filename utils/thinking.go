@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"claude2api/config"
+	"claude2api/logger"
+	"fmt"
+	"regexp"
+)
+
+// 代理在 -think 模型的回复中写入的思考过程
+var thinkingBlockRegex = regexp.MustCompile(`(?s)<think>.*?</think>\s*`)
+
+// StripThinkingFromHistory 去除历史 assistant 消息中的 <think> 思考块
+// 配置了 ThinkingStrippedMarker 时用该标记代替被去除的内容，否则直接删除
+func (p *ChatRequestProcessor) StripThinkingFromHistory() {
+	replacement := ""
+	if config.ConfigInstance.ThinkingStrippedMarker != "" {
+		replacement = config.ConfigInstance.ThinkingStrippedMarker + "\n\n"
+	}
+	stripped := p.rewriteAssistantText(func(text string) string {
+		return thinkingBlockRegex.ReplaceAllString(text, replacement)
+	})
+	if stripped > 0 {
+		logger.Info(fmt.Sprintf("Stripped thinking from %d assistant messages", stripped))
+	}
+}
+
+// rewriteAssistantText 对 assistant 消息的文本内容应用 rewrite，返回被修改的消息数
+// 被修改的消息和内容项会被复制，不会改动调用方传入的消息
+func (p *ChatRequestProcessor) rewriteAssistantText(rewrite func(string) string) int {
+	rewritten := 0
+	messages := make([]map[string]interface{}, 0, len(p.Messages))
+	for _, msg := range p.Messages {
+		if role, _ := msg["role"].(string); role != "assistant" {
+			messages = append(messages, msg)
+			continue
+		}
+
+		var content interface{}
+		switch v := msg["content"].(type) {
+		case string:
+			content = rewrite(v)
+		case []interface{}:
+			items := make([]interface{}, 0, len(v))
+			for _, item := range v {
+				itemMap, ok := item.(map[string]interface{})
+				if text, isText := itemMap["text"].(string); ok && isText {
+					copied := make(map[string]interface{}, len(itemMap))
+					for key, value := range itemMap {
+						copied[key] = value
+					}
+					copied["text"] = rewrite(text)
+					item = copied
+				}
+				items = append(items, item)
+			}
+			content = items
+		default:
+			messages = append(messages, msg)
+			continue
+		}
+		if contentText(content) == contentText(msg["content"]) {
+			messages = append(messages, msg)
+			continue
+		}
+
+		copied := make(map[string]interface{}, len(msg))
+		for key, value := range msg {
+			copied[key] = value
+		}
+		copied["content"] = content
+		messages = append(messages, copied)
+		rewritten++
+	}
+	p.Messages = messages
+	return rewritten
+}
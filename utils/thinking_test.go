@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"claude2api/config"
+	"reflect"
+	"testing"
+)
+
+func TestStripThinkingFromHistory(t *testing.T) {
+	tests := []struct {
+		name    string
+		marker  string
+		content interface{}
+		want    interface{}
+	}{
+		{"removed", "", "<think>Plan the answer.</think>\nHello", "Hello"},
+		{"replaced by marker", "[thinking omitted]", "<think>Plan the answer.</think>\nHello", "[thinking omitted]\n\nHello"},
+		{"multiline thinking", "", "<think>Step 1\nStep 2</think>\n\nHello", "Hello"},
+		{"content items", "", []interface{}{textItem("<think>Plan</think>\nHello")}, []interface{}{textItem("Hello")}},
+		{"no thinking", "[thinking omitted]", "Hello", "Hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.ConfigInstance.ThinkingStrippedMarker, tt.marker)
+			original := []map[string]interface{}{
+				{"role": "user", "content": "<think>user text is kept</think>"},
+				{"role": "assistant", "content": tt.content},
+			}
+			p := NewChatRequestProcessor()
+			p.Messages = original
+			p.StripThinkingFromHistory()
+			if got := p.Messages[1]["content"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("assistant content = %q, want %q", got, tt.want)
+			}
+			if got := p.Messages[0]["content"]; got != "<think>user text is kept</think>" {
+				t.Errorf("user content = %q, want it unchanged", got)
+			}
+			if !reflect.DeepEqual(original[1]["content"], tt.content) {
+				t.Errorf("caller's message was modified: %q", original[1]["content"])
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var (
+	markdownLinkRegex  = regexp.MustCompile(`!?\[([^\]]*)\]\([^)]*\)`)
+	markdownFenceRegex = regexp.MustCompile("```[a-zA-Z0-9_-]*")
+	markdownMarkRegex  = regexp.MustCompile("[*_`~#>|]+")
+)
+
+// DeriveTitle 根据第一条用户消息生成会话标题，去除控制字符和 markdown 标记，最多保留 maxLen 个字符
+func (p *ChatRequestProcessor) DeriveTitle(maxLen int) string {
+	if maxLen <= 0 {
+		return ""
+	}
+	for _, msg := range p.Messages {
+		if role, ok := msg["role"].(string); ok && role == "user" {
+			if title := sanitizeTitle(contentText(msg["content"]), maxLen); title != "" {
+				return title
+			}
+		}
+	}
+	return ""
+}
+
+func sanitizeTitle(text string, maxLen int) string {
+	text = markdownFenceRegex.ReplaceAllString(text, " ")
+	text = markdownLinkRegex.ReplaceAllString(text, "$1")
+	text = markdownMarkRegex.ReplaceAllString(text, " ")
+
+	// 控制字符替换为空格（保留 emoji 组合用的零宽连接符），连续空白合并为一个
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || (unicode.Is(unicode.Cf, r) && r != '\u200d') {
+			return ' '
+		}
+		return r
+	}, text)
+	text = strings.Join(strings.Fields(text), " ")
+
+	// 按字符截断，避免切断多字节字符
+	// 截断处可能位于 emoji 组合序列中间，去掉末尾悬空的零宽连接符和变体选择符
+	runes := []rune(text)
+	if len(runes) > maxLen {
+		text = strings.TrimRightFunc(string(runes[:maxLen]), func(r rune) bool {
+			return unicode.IsSpace(r) || r == '\u200d' || unicode.Is(unicode.Variation_Selector, r)
+		})
+	}
+	return text
+}
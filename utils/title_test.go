@@ -0,0 +1,29 @@
+package utils
+
+import "testing"
+
+func TestSanitizeTitle(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		maxLen int
+		want   string
+	}{
+		{"plain", "Hello there", 50, "Hello there"},
+		{"markdown", "# **Fix** the `bug` in [docs](http://x)", 50, "Fix the bug in docs"},
+		{"control characters", "line one\nline\ttwo\u0007", 50, "line one line two"},
+		{"truncated", "Hello there", 5, "Hello"},
+		{"truncated at a space", "Hello there", 6, "Hello"},
+		{"multibyte", "你好世界朋友", 4, "你好世界"},
+		{"emoji sequence kept whole", "Hi 👨‍👩‍👧 family", 50, "Hi 👨‍👩‍👧 family"},
+		{"dangling joiner", "Hi 👨‍👩‍👧 family", 5, "Hi 👨"},
+		{"dangling variation selector", "Love ❤️‍🔥 you", 7, "Love ❤"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeTitle(tt.text, tt.maxLen); got != tt.want {
+				t.Errorf("sanitizeTitle(%q, %d) = %q, want %q", tt.text, tt.maxLen, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"claude2api/logger"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// 各模型单次回复的最大输出 token 数
+var modelMaxOutputTokens = map[string]int{
+	"claude-3-7-sonnet": 64000,
+}
+
+const defaultMaxOutputTokens = 8192
+
+// 超过该长度的无空白片段（如粘贴的 base64）按每 2 个字符约 1 个 token 估算
+const longWordRunes = 100
+
+// GetModelMaxOutputTokens 返回模型允许的最大输出 token 数
+func GetModelMaxOutputTokens(model string) int {
+	for prefix, limit := range modelMaxOutputTokens {
+		if strings.HasPrefix(model, prefix) {
+			return limit
+		}
+	}
+	return defaultMaxOutputTokens
+}
+
+// ResolveMaxTokens 解析客户端的 max_tokens 和 max_completion_tokens，后者优先
+// 返回 0 表示未限制，超过模型上限时截断为模型上限
+func ResolveMaxTokens(model string, maxTokens int, maxCompletionTokens int) (int, error) {
+	value, field := maxTokens, "max_tokens"
+	if maxCompletionTokens != 0 {
+		value, field = maxCompletionTokens, "max_completion_tokens"
+	}
+	if value == 0 {
+		return 0, nil
+	}
+	if value < 0 {
+		return 0, fmt.Errorf("%s must be positive, got %d", field, value)
+	}
+	if limit := GetModelMaxOutputTokens(model); value > limit {
+		logger.Warn(fmt.Sprintf("%s (%d) exceeds the limit of model %s, clamping to %d", field, value, model, limit))
+		return limit, nil
+	}
+	return value, nil
+}
+
+// EstimateTokens 估算提示词和图片的总 token 数，文本按每 4 个字符约 1 个 token 计算
+func (p *ChatRequestProcessor) EstimateTokens() int {
+	tokens := EstimateTextTokens(p.Prompt.String())
+	for _, img := range p.ImgDataList {
+		tokens += EstimateImageTokens(img)
+	}
+	return tokens
+}
+
+// EstimateTextTokens 按每 4 个字符约 1 个 token 估算文本的 token 数
+// 很长的无空白片段切分效果差，按 longWordRunes 的规则提高估算值，避免低估
+func EstimateTextTokens(text string) int {
+	tokens := utf8.RuneCountInString(text) / 4
+	for _, word := range strings.Fields(text) {
+		if runes := utf8.RuneCountInString(word); runes >= longWordRunes {
+			tokens += runes/2 - runes/4
+		}
+	}
+	return tokens
+}
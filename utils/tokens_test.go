@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"claude2api/model"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestResolveMaxTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		model   string
+		want    int
+		wantErr bool
+	}{
+		{"unset", `{}`, "claude-3-7-sonnet-20250219", 0, false},
+		{"max_tokens", `{"max_tokens": 100}`, "claude-3-7-sonnet-20250219", 100, false},
+		{"max_completion_tokens", `{"max_completion_tokens": 200}`, "claude-3-7-sonnet-20250219", 200, false},
+		{"max_completion_tokens wins", `{"max_tokens": 100, "max_completion_tokens": 200}`, "claude-3-7-sonnet-20250219", 200, false},
+		{"clamped to model limit", `{"max_tokens": 100000}`, "claude-3-7-sonnet-20250219", 64000, false},
+		{"clamped to default limit", `{"max_tokens": 100000}`, "claude-3-5-haiku", defaultMaxOutputTokens, false},
+		{"negative", `{"max_completion_tokens": -1}`, "claude-3-7-sonnet-20250219", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req model.ChatCompletionRequest
+			if err := json.Unmarshal([]byte(tt.body), &req); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ResolveMaxTokens(tt.model, req.MaxTokens, req.MaxCompletionTokens)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveMaxTokens() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ResolveMaxTokens() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEstimateTextTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want int
+	}{
+		{"empty", "", 0},
+		{"prose", strings.Repeat("word ", 100), 125},
+		{"short word below threshold", strings.Repeat("a", longWordRunes-1), (longWordRunes - 1) / 4},
+		{"long whitespace-free string", strings.Repeat("Q", 50000), 25000},
+		{"long word inside prose", strings.Repeat("word ", 100) + strings.Repeat("Q", 400), 125 + 100 + 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EstimateTextTokens(tt.text); got != tt.want {
+				t.Errorf("EstimateTextTokens() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
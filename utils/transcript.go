@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// 对话记录中各角色的标签
+var transcriptRoleLabels = map[string]string{
+	"system":    "System",
+	"user":      "User",
+	"assistant": "Assistant",
+	"tool":      "Tool",
+}
+
+// AsTranscript 把消息转换为带角色标签的对话记录，不使用代理的角色前缀，用作总结、分析对话等请求的内容
+// 图片写为 [Image]，assistant 的 tool_calls 写为 JSON
+func (p *ChatRequestProcessor) AsTranscript() string {
+	var turns []string
+	for _, msg := range p.Messages {
+		role, _ := msg["role"].(string)
+		label, ok := transcriptRoleLabels[role]
+		if !ok {
+			continue
+		}
+
+		var parts []string
+		if text := strings.TrimSpace(contentText(msg["content"])); text != "" {
+			parts = append(parts, text)
+		}
+		for i := 0; i < countImages(msg["content"]); i++ {
+			parts = append(parts, ImagePlaceholder)
+		}
+		if toolCalls, ok := msg["tool_calls"].([]interface{}); ok && len(toolCalls) > 0 {
+			if toolCallsJSON, err := json.Marshal(toolCalls); err == nil {
+				parts = append(parts, "Tool calls: "+string(toolCallsJSON))
+			}
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		turns = append(turns, fmt.Sprintf("%s: %s", label, strings.Join(parts, "\n")))
+	}
+	return strings.Join(turns, "\n\n")
+}
+
+// countImages 返回消息内容中的图片数量
+func countImages(content interface{}) int {
+	switch v := content.(type) {
+	case []interface{}:
+		count := 0
+		for _, item := range v {
+			count += countImages(item)
+		}
+		return count
+	case map[string]interface{}:
+		if contentHasImage(v) {
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,30 @@
+package utils
+
+import "testing"
+
+func TestAsTranscript(t *testing.T) {
+	tests := []struct {
+		name string
+		msgs []map[string]interface{}
+		want string
+	}{
+		{"labeled turns", messages("system", "Be brief.", "user", "Hi", "assistant", "Hello"), "System: Be brief.\n\nUser: Hi\n\nAssistant: Hello"},
+		{"images", []map[string]interface{}{
+			{"role": "user", "content": []interface{}{textItem("Compare"), imageItem("https://example.com/a.png"), imageItem("https://example.com/b.png")}},
+		}, "User: Compare\n[Image]\n[Image]"},
+		{"tool calls and results", []map[string]interface{}{
+			{"role": "assistant", "tool_calls": []interface{}{map[string]interface{}{"id": "call_1"}}},
+			{"role": "tool", "tool_call_id": "call_1", "content": "Sunny"},
+		}, "Assistant: Tool calls: [{\"id\":\"call_1\"}]\n\nTool: Sunny"},
+		{"empty and unknown turns skipped", messages("user", "Hi", "assistant", "  ", "developer", "hidden"), "User: Hi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewChatRequestProcessor()
+			p.Messages = tt.msgs
+			if got := p.AsTranscript(); got != tt.want {
+				t.Errorf("AsTranscript() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
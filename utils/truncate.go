@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"claude2api/config"
+	"claude2api/logger"
+	"fmt"
+)
+
+// 截断最新用户消息时在保留的开头和结尾之间插入的标记
+const userTruncatedMarker = "\n\n[... message truncated to fit the context limit ...]\n\n"
+
+// fitLatestUserMessage 处理超过 MaxPromptTokens 的提示词
+// OversizedUserPolicy 为 error 时返回错误，为 truncate 时保留最新用户消息的开头和结尾，截断中间部分并重新生成提示词
+// 最新用户消息按处理后的消息确定，已去掉末尾的空白轮次并合并末尾连续的用户消息；截断后仍放不下时同样返回错误
+func (p *ChatRequestProcessor) fitLatestUserMessage() error {
+	maxTokens := config.ConfigInstance.MaxPromptTokens
+	if maxTokens <= 0 || p.truncatedUser != "" {
+		return nil
+	}
+	total := p.EstimateTokens()
+	if total <= maxTokens {
+		return nil
+	}
+	tooLarge := fmt.Errorf("prompt has about %d tokens, exceeding the limit of %d", total, maxTokens)
+	if config.ConfigInstance.OversizedUserPolicy != "truncate" {
+		return tooLarge
+	}
+
+	latest := p.latestUserTurn()
+	if latest < 0 {
+		return tooLarge
+	}
+	text := contentText(p.Messages[latest]["content"])
+	userTokens := EstimateTextTokens(text)
+	allowed := maxTokens - (total - userTokens)
+	if allowed <= 0 || userTokens == 0 {
+		logger.Warn(fmt.Sprintf("Prompt exceeds max prompt tokens (%d) even without the latest user message", maxTokens))
+		return tooLarge
+	}
+
+	// 按 token 比例计算保留的字符数，兼顾很长的无空白片段
+	runes := []rune(text)
+	keep := len(runes)*allowed/userTokens - len([]rune(userTruncatedMarker))
+	if keep <= 0 {
+		keep = 0
+	}
+	head := keep / 2
+	truncated := string(runes[:head]) + userTruncatedMarker + string(runes[len(runes)-(keep-head):])
+	logger.Warn(fmt.Sprintf("Latest user message truncated to fit max prompt tokens (%d): %d -> %d chars", maxTokens, len(runes), keep))
+
+	p.reset()
+	p.truncatedUser = truncated
+	return p.ProcessMessages(p.inputMessages)
+}
+
+// latestUserTurn 返回 p.Messages 中最后一条用户消息的下标，没有时返回 -1
+func (p *ChatRequestProcessor) latestUserTurn() int {
+	for i := len(p.Messages) - 1; i >= 0; i-- {
+		if role, _ := p.Messages[i]["role"].(string); role == "user" {
+			return i
+		}
+	}
+	return -1
+}
+
+// applyTruncatedUser 用截断后的文本替换处理后的最新用户消息，保留图片，不修改客户端传入的消息
+func (p *ChatRequestProcessor) applyTruncatedUser() {
+	latest := p.latestUserTurn()
+	if p.truncatedUser == "" || latest < 0 {
+		return
+	}
+	message := make(map[string]interface{}, len(p.Messages[latest]))
+	for key, value := range p.Messages[latest] {
+		message[key] = value
+	}
+	message["content"] = replaceContentText(message["content"], p.truncatedUser)
+	p.Messages = append([]map[string]interface{}{}, p.Messages...)
+	p.Messages[latest] = message
+}
+
+// replaceContentText 用 text 替换消息内容中的所有文本，保留图片
+func replaceContentText(content interface{}, text string) interface{} {
+	var items []interface{}
+	switch v := content.(type) {
+	case []interface{}:
+		items = v
+	case map[string]interface{}:
+		items = []interface{}{v}
+	default:
+		return text
+	}
+	replaced := []interface{}{map[string]interface{}{"type": "text", "text": text}}
+	for _, item := range items {
+		if itemMap, ok := item.(map[string]interface{}); ok && contentHasImage(itemMap) {
+			replaced = append(replaced, itemMap)
+		}
+	}
+	return replaced
+}
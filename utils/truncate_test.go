@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"claude2api/config"
+	"strings"
+	"testing"
+)
+
+func TestFitLatestUserMessage(t *testing.T) {
+	setConfig(t, &config.ConfigInstance.MaxPromptTokens, 100)
+	setConfig(t, &config.ConfigInstance.GlobalSystemPrompt, "")
+
+	setConfig(t, &config.ConfigInstance.TrailingBlankUserPolicy, "drop")
+
+	long := "HEAD " + strings.Repeat("middle words ", 200) + " TAIL"
+	tests := []struct {
+		name     string
+		policy   string
+		merge    bool
+		messages []map[string]interface{}
+		wantErr  bool
+		want     []string
+	}{
+		{"fits", "error", false, messages("user", "earlier", "assistant", "ok", "user", "short question"), false, []string{"short question"}},
+		{"error rejects", "error", false, messages("user", "earlier", "assistant", "ok", "user", long), true, nil},
+		{"truncate keeps head and tail", "truncate", false, messages("user", "earlier", "assistant", "ok", "user", long), false, []string{"HEAD", "TAIL", strings.TrimSpace(userTruncatedMarker)}},
+		{"truncate after blank turn dropped", "truncate", false, messages("user", long, "user", "  "), false, []string{"HEAD", "TAIL", strings.TrimSpace(userTruncatedMarker)}},
+		{"truncate merged trailing users", "truncate", true, messages("user", long, "user", "short tail"), false, []string{"HEAD", "short tail", strings.TrimSpace(userTruncatedMarker)}},
+		{"truncate cannot fit without the user message", "truncate", false, messages("system", long, "user", "short question"), true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.ConfigInstance.OversizedUserPolicy, tt.policy)
+			setConfig(t, &config.ConfigInstance.MergeTrailingUserMessages, tt.merge)
+			p := NewChatRequestProcessor()
+			err := p.ProcessMessages(tt.messages)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ProcessMessages() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			prompt := p.Prompt.String()
+			for _, want := range tt.want {
+				if !strings.Contains(prompt, want) {
+					t.Errorf("prompt does not contain %q: %q", want, prompt)
+				}
+			}
+			if tokens := p.EstimateTokens(); tokens > 100 {
+				t.Errorf("EstimateTokens() = %d, want <= 100", tokens)
+			}
+			if p.RootPrompt.String() != prompt {
+				t.Errorf("root prompt was not rebuilt with the truncated message")
+			}
+			if got := contentText(tt.messages[len(tt.messages)-1]["content"]); strings.Contains(got, strings.TrimSpace(userTruncatedMarker)) {
+				t.Errorf("client message was modified: %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"claude2api/config"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Validate 对处理后的请求执行 RequestValidations 中配置的检查
+// 返回包含所有问题的错误，而不是在第一个问题处停止
+func (p *ChatRequestProcessor) Validate() error {
+	var errs []error
+	for _, rule := range config.ConfigInstance.RequestValidations {
+		switch rule {
+		case "alternation":
+			errs = append(errs, p.validateAlternation()...)
+		case "user_first":
+			errs = append(errs, p.validateUserFirst()...)
+		case "references":
+			errs = append(errs, p.validateReferences()...)
+		case "size":
+			errs = append(errs, p.validateSize()...)
+		case "system":
+			errs = append(errs, p.validateSystem()...)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateAlternation 检查 user 和 assistant 消息是否交替出现
+func (p *ChatRequestProcessor) validateAlternation() []error {
+	var errs []error
+	previous := ""
+	for i, msg := range p.Messages {
+		role, _ := msg["role"].(string)
+		if role != "user" && role != "assistant" {
+			continue
+		}
+		if role == previous {
+			errs = append(errs, fmt.Errorf("message %d: consecutive %s messages", i, role))
+		}
+		previous = role
+	}
+	return errs
+}
+
+// validateUserFirst 检查 system 消息之后的第一条消息是否为 user 消息
+func (p *ChatRequestProcessor) validateUserFirst() []error {
+	for i, msg := range p.Messages {
+		role, _ := msg["role"].(string)
+		if role == "system" {
+			continue
+		}
+		if role != "user" {
+			return []error{fmt.Errorf("message %d: first message must be from user, got %s", i, role)}
+		}
+		return nil
+	}
+	return []error{errors.New("request has no user message")}
+}
+
+// validateReferences 检查 tool 消息的 tool_call_id 是否对应之前 assistant 消息中的 tool_calls
+func (p *ChatRequestProcessor) validateReferences() []error {
+	var errs []error
+	var ids []string
+	for i, msg := range p.Messages {
+		role, _ := msg["role"].(string)
+		if toolCalls, ok := msg["tool_calls"].([]interface{}); ok && role == "assistant" {
+			for _, call := range toolCalls {
+				if callMap, ok := call.(map[string]interface{}); ok {
+					if id, ok := callMap["id"].(string); ok {
+						ids = append(ids, id)
+					}
+				}
+			}
+		}
+		if role != "tool" {
+			continue
+		}
+		id, _ := msg["tool_call_id"].(string)
+		if !slices.Contains(ids, id) {
+			errs = append(errs, fmt.Errorf("message %d: tool_call_id %q does not match any earlier tool call", i, id))
+		}
+	}
+	return errs
+}
+
+// validateSize 检查估算的提示词 token 数是否超过 MaxPromptTokens
+func (p *ChatRequestProcessor) validateSize() []error {
+	maxTokens := config.ConfigInstance.MaxPromptTokens
+	if maxTokens <= 0 {
+		return nil
+	}
+	if tokens := p.EstimateTokens(); tokens > maxTokens {
+		return []error{fmt.Errorf("prompt has about %d tokens, exceeding the limit of %d", tokens, maxTokens)}
+	}
+	return nil
+}
+
+// validateSystem 检查请求是否包含非空的 system 消息
+func (p *ChatRequestProcessor) validateSystem() []error {
+	for _, msg := range p.Messages {
+		if role, _ := msg["role"].(string); role == "system" && strings.TrimSpace(contentText(msg["content"])) != "" {
+			return nil
+		}
+	}
+	return []error{errors.New("request must include a system message")}
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"claude2api/config"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	valid := []map[string]interface{}{
+		{"role": "system", "content": "Be brief."},
+		{"role": "user", "content": "Weather?"},
+		{"role": "assistant", "tool_calls": []interface{}{map[string]interface{}{"id": "call_1"}}},
+		{"role": "tool", "tool_call_id": "call_1", "content": "Sunny"},
+		{"role": "user", "content": "Thanks"},
+	}
+	invalid := []map[string]interface{}{
+		{"role": "assistant", "content": "Hello"},
+		{"role": "assistant", "content": "Hello again"},
+		{"role": "tool", "tool_call_id": "call_9", "content": "Sunny"},
+		{"role": "user", "content": "Hi"},
+	}
+	tests := []struct {
+		name     string
+		rules    []string
+		msgs     []map[string]interface{}
+		wantErrs []string
+	}{
+		{"valid request", []string{"alternation", "user_first", "references", "system"}, valid, nil},
+		{"no rules", nil, invalid, nil},
+		{"three violations", []string{"alternation", "user_first", "references"}, invalid, []string{
+			"message 1: consecutive assistant messages",
+			"message 0: first message must be from user, got assistant",
+			`message 2: tool_call_id "call_9" does not match any earlier tool call`,
+		}},
+		{"missing system", []string{"system"}, invalid, []string{"request must include a system message"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &config.ConfigInstance.RequestValidations, tt.rules)
+			p := NewChatRequestProcessor()
+			p.Messages = tt.msgs
+			err := p.Validate()
+			if tt.wantErrs == nil {
+				if err != nil {
+					t.Fatalf("Validate() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("Validate() error = nil, want errors")
+			}
+			if got, want := err.Error(), strings.Join(tt.wantErrs, "\n"); got != want {
+				t.Errorf("Validate() error = %q, want %q", got, want)
+			}
+		})
+	}
+}
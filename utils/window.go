@@ -0,0 +1,23 @@
+package utils
+
+// SlidingWindow 把处理后的提示词按字符切分为相互重叠的窗口，调用方可以分别查询每个窗口再合并结果
+// 每个窗口最多 size 个字符，相邻窗口重叠 overlap 个字符；overlap 无效时不重叠
+func (p *ChatRequestProcessor) SlidingWindow(size int, overlap int) []string {
+	if size <= 0 {
+		return nil
+	}
+	if overlap < 0 || overlap >= size {
+		overlap = 0
+	}
+
+	runes := []rune(p.Prompt.String())
+	var windows []string
+	for start := 0; start < len(runes); start += size - overlap {
+		end := min(start+size, len(runes))
+		windows = append(windows, string(runes[start:end]))
+		if end == len(runes) {
+			break
+		}
+	}
+	return windows
+}
@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSlidingWindow(t *testing.T) {
+	tests := []struct {
+		name    string
+		prompt  string
+		size    int
+		overlap int
+		want    []string
+	}{
+		{"no overlap", "abcdefgh", 3, 0, []string{"abc", "def", "gh"}},
+		{"overlap", "abcdefgh", 4, 2, []string{"abcd", "cdef", "efgh"}},
+		{"last window is shorter", "abcdefghi", 4, 1, []string{"abcd", "defg", "ghi"}},
+		{"prompt fits one window", "abc", 10, 2, []string{"abc"}},
+		{"overlap not smaller than size", "abcdef", 3, 3, []string{"abc", "def"}},
+		{"negative overlap", "abcdef", 3, -1, []string{"abc", "def"}},
+		{"multibyte runes", "你好世界朋友", 4, 2, []string{"你好世界", "世界朋友"}},
+		{"invalid size", "abc", 0, 0, nil},
+		{"empty prompt", "", 3, 1, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewChatRequestProcessor()
+			p.Prompt.WriteString(tt.prompt)
+			if got := p.SlidingWindow(tt.size, tt.overlap); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SlidingWindow(%d, %d) = %q, want %q", tt.size, tt.overlap, got, tt.want)
+			}
+		})
+	}
+}